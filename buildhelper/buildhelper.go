@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"go/build"
 	"log"
 	"os"
@@ -8,34 +10,214 @@ import (
 	"strings"
 )
 
+// runOptions are the optional settings of a Run (set with command line flags).
+type runOptions struct {
+	test       bool     // build a test binary for the input package instead of the package itself
+	test2JSON  bool     // the test binary converts its output to test2json events
+	zip        string   // zip archive with the sources of the input directory (only the files to compile are extracted)
+	overlay    string   // JSON file that replaces the contents of source files (like go build -overlay)
+	instrument string   // comma-separated instrumentation hooks added to the main package (see instrumentationHooks)
+	check      bool     // only type-check the packages of the user (see checkPackages) instead of planning the build
+	lsp        bool     // serve the language server protocol on stdin/stdout (see serveLSP) instead of building
+	manifest   bool     // write the manifest of the precompiled standard library (see writeStdManifest) instead of building
+	files      []string // more .go files of the main package, after the input file (like go run a.go b.go)
+	x          bool     // print the actions of the plan (like go build -x)
+}
+
 func main() {
-	if len(os.Args) != 4 {
-		log.Fatal("Usage: ", os.Args[0], " <input-go-package> <output-dir> <build-tag1,build-tag2>\n"+
+	var opts runOptions
+	flag.BoolVar(&opts.test, "test", false, "build a test binary (like go test -c) for the input package, "+
+		"that accepts the usual -test.run/-test.v/-test.bench flags")
+	flag.BoolVar(&opts.test2JSON, "test2json", false, "with -test, the test binary prints test2json events (like "+
+		"go test -json) after all tests finish")
+	flag.StringVar(&opts.zip, "zip", "", "load the sources from this zip archive, as if it was extracted at the input "+
+		"directory (only the files needed by the build are extracted)")
+	flag.StringVar(&opts.overlay, "overlay", "", "JSON file that replaces source files, adds or deletes them, like "+
+		"go build -overlay: {\"Replace\": {\"<source-path>\": \"<replacement-path or empty to delete>\"}}")
+	flag.StringVar(&opts.instrument, "instrument", "", "comma-separated hooks to add to the main package, in a "+
+		"generated file: stop (the JS host stops the program with the global function named by $"+stopFnEnvVar+"), "+
+		"panicjson (report a panic of main as a JSON line on stderr), flush (sync stdout and stderr on exit)")
+	flag.BoolVar(&opts.check, "check", false, "only type-check the packages of the user, using the compiled archives "+
+		"of their dependencies: errors are reported as diagnostics, and no build plan is generated")
+	flag.BoolVar(&opts.lsp, "lsp", false, "serve completion, hover, go-to-definition and find-references (a subset of "+
+		"the language server protocol) on stdin/stdout until exit, instead of building: takes only <output-dir> and "+
+		"<build-tags>")
+	flag.BoolVar(&opts.manifest, "stdmanifest", false, "write the manifest of the sources of the precompiled standard "+
+		"library of the target, so that edits to those sources are detected and rebuilt, instead of building: takes "+
+		"only <build-tags>")
+	flag.BoolVar(&opts.x, "x", false, "print the actions of the plan (and their commands, like go build -x)")
+	flag.Usage = func() {
+		log.Print("Usage: ", os.Args[0], " [flags] <input-go-package> <output-dir> <build-tag1,build-tag2>\n"+
+			"       "+os.Args[0]+" [flags] <file1.go> [file2.go ...] <output-dir> <build-tag1,build-tag2>\n"+
+			"       "+os.Args[0]+" -lsp <output-dir> <build-tag1,build-tag2>\n"+
+			"       "+os.Args[0]+" -stdmanifest <build-tag1,build-tag2>\n"+
 			"Environment variables:\n"+
-			" - ALSO_EXECUTE_COMMANDS: if set, executes all command after generating them to build the executable\n")
+			" - ALSO_EXECUTE_COMMANDS: if set, executes all actions after generating them to build the executable\n"+
+			" - BUILDHELPER_CACHE: directory to store compiled packages, shared by all builds (default: $TMPDIR/buildhelper-cache)\n"+
+			" - GOAMD64, GOARM, GOARM64, GO386, GOMIPS, GOMIPS64, GOPPC64, GORISCV64, GOWASM: variant of the target GOARCH\n"+
+			" - GOEXPERIMENT: comma-separated toolchain experiments to enable (or disable with a no prefix)\n"+
+			" - CGO_ENABLED: cgo is disabled unless it is 1, which fails with a report of the files that require cgo (also\n"+
+			"   reported without fallbacks when cgo is disabled)\n"+
+			"Flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if opts.lsp && flag.NArg() == 2 {
+		buildCtx, err := newBuildContext(strings.Split(flag.Arg(1), ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = serveLSP(flag.Arg(0), buildCtx, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if opts.manifest && flag.NArg() == 1 {
+		buildCtx, err := newBuildContext(strings.Split(flag.Arg(0), ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = writeStdManifest(newSources(), buildCtx); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	Run(os.Args[1], os.Args[2], strings.Split(os.Args[3], ","))
+	if flag.NArg() < 3 || opts.lsp || opts.manifest {
+		flag.Usage()
+		os.Exit(1)
+	}
+	inputs := flag.Args()[:flag.NArg()-2]
+	if len(inputs) > 1 { // Like go run a.go b.go
+		for _, input := range inputs {
+			if !strings.HasSuffix(input, ".go") {
+				log.Fatal("more than one input is only allowed for .go files of the main package, not ", input)
+			}
+		}
+		opts.files = inputs[1:]
+	}
+	Run(inputs[0], flag.Arg(flag.NArg()-2), strings.Split(flag.Arg(flag.NArg()-1), ","), opts)
 }
 
-func Run(input, buildDir string, buildTags []string) {
+func Run(input, buildDir string, buildTags []string, opts runOptions) {
 	buildDir, err := filepath.Abs(buildDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	removeDiagnostics(buildDir)
+	srcs := newSources() // Mounted file systems and overlay of this build only
+	for _, file := range opts.files {
+		fileAbs, err := filepath.Abs(file)
+		if err != nil {
+			fatal(buildDir, err, srcs)
+		}
+		srcs.moreInputFiles = append(srcs.moreInputFiles, fileAbs)
+	}
+	if opts.overlay != "" {
+		if err = srcs.loadOverlay(opts.overlay); err != nil {
+			fatal(buildDir, err, srcs)
+		}
+	}
+	pattern := isPackagePattern(input)
+	if pattern && (opts.test || opts.instrument != "" || len(opts.files) > 0) {
+		fatal(buildDir, errors.New("package patterns cannot be combined with -test, -instrument or more input files"), srcs)
+	}
+	if opts.zip != "" {
+		zipSources, err := openZipFS(opts.zip)
+		if err != nil {
+			fatal(buildDir, err, srcs)
+		}
+		mountDir := input
+		if pattern {
+			if mountDir, err = patternRootDir(input); err != nil {
+				fatal(buildDir, err, srcs)
+			}
+		}
+		if err = srcs.mount(mountDir, zipSources); err != nil {
+			fatal(buildDir, err, srcs)
+		}
+	}
 	// Parse import tree (using custom tags)
-	buildCtx := build.Default
-	buildCtx.BuildTags = append(buildCtx.BuildTags, buildTags...)
-	parsedTree, precompiledInternal, err := parse(input, buildDir, buildCtx)
+	buildCtx, err := newBuildContext(buildTags)
 	if err != nil {
-		log.Fatal(err)
+		fatal(buildDir, err, srcs)
+	}
+	if opts.instrument != "" {
+		if opts.test {
+			fatal(buildDir, errors.New("-instrument only applies to main packages, not to tests"), srcs)
+		}
+		if err = instrumentMain(input, buildDir, strings.Split(opts.instrument, ","), srcs, buildCtx); err != nil {
+			fatal(buildDir, err, srcs)
+		}
+	}
+	var roots []*parsedTreeNode
+	var precompiledInternal bool
+	if opts.test {
+		var parsedTree *parsedTreeNode
+		parsedTree, precompiledInternal, err = parseTest(input, buildDir, srcs, buildCtx, opts.test2JSON)
+		roots = []*parsedTreeNode{parsedTree}
+	} else if pattern {
+		roots, precompiledInternal, err = parsePattern(input, srcs, buildCtx)
+	} else {
+		var parsedTree *parsedTreeNode
+		parsedTree, precompiledInternal, err = parse(input, srcs, buildCtx)
+		roots = []*parsedTreeNode{parsedTree}
 	}
-	// Generate compile commands
-	importCfg, commands, linkPackages, err := compile(parsedTree, buildDir, precompiledInternal, buildCtx)
 	if err != nil {
-		log.Fatal(err)
+		fatal(buildDir, err, srcs)
+	}
+	// Prepare the archive cache (shared by all builds)
+	err = os.MkdirAll(cacheDir(), 0755)
+	if err != nil {
+		fatal(buildDir, err, srcs)
+	}
+	// Generate compile actions
+	importCfg, actions, targets, err := compilePackages(roots, buildDir, precompiledInternal, srcs, buildCtx)
+	if err != nil {
+		fatal(buildDir, err, srcs)
+	}
+	if opts.check {
+		diagnostics, err := checkPackages(roots, importCfg.Name(), srcs, buildCtx)
+		if err != nil {
+			fatal(buildDir, err, srcs)
+		}
+		if len(diagnostics) > 0 {
+			writeDiagnostics(buildDir, diagnostics)
+			for _, d := range diagnostics {
+				log.Printf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+			}
+			log.Fatal("type-checking failed with ", len(diagnostics), " errors")
+		}
+		log.Println("Type-checking succeeded")
+		return
+	}
+	// Generate final link action(s)
+	if pattern {
+		if actions, err = linkMains(importCfg, targets, actions, buildDir, srcs, buildCtx); err != nil {
+			fatal(buildDir, err, srcs)
+		}
+	} else {
+		actions = link(importCfg, targets[0].packages, actions, buildDir, defaultGoDebug(roots[0], srcs, buildCtx))
+	}
+	// All tools must target the same variant of the architecture (the compiler and linker read it from the environment)
+	for _, a := range actions {
+		a.Env = subArchSettings(buildCtx)
+	}
+	if err = srcs.extractMountedInputs(actions); err != nil {
+		fatal(buildDir, err, srcs)
 	}
-	// Generate final link command
-	commands = link(importCfg, linkPackages, commands, buildDir)
 	// Output
-	output(commands, buildDir, err)
+	output(actions, buildDir, srcs, opts.x)
+}
+
+// newBuildContext returns the build context of the target (from the environment) with the given build tags, and the
+// tags of its variant.
+func newBuildContext(buildTags []string) (build.Context, error) {
+	buildCtx := build.Default
+	buildCtx.BuildTags = append(buildCtx.BuildTags, buildTags...)
+	buildCtx.CgoEnabled = cgoEnabled()
+	if err := checkSubArch(buildCtx); err != nil {
+		return buildCtx, err
+	}
+	buildCtx.BuildTags = append(buildCtx.BuildTags, subArchTags(buildCtx)...)
+	return buildCtx, nil
 }
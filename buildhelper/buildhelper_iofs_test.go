@@ -0,0 +1,39 @@
+//go:build go1.16
+// +build go1.16
+
+package main
+
+import (
+	"go/build"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFSSources(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src") // Only in memory
+	srcs := newSources()
+	err := srcs.mountIOFS(src, fstest.MapFS{
+		"go.mod":      {Data: []byte("module example.com/m\n")},
+		"main.go":     {Data: []byte("package main\n\nimport \"example.com/m/a\"\n\nfunc main() { a.A() }\n")},
+		"a/a.go":      {Data: []byte("package a\n\nfunc A() {}\n")},
+		"a/a_js.go":   {Data: []byte("package a\n")},
+		"a/a_asm.s":   {Data: []byte("")},
+		"a/a_test.go": {Data: []byte("package a\n")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH = "linux", "amd64"
+	tree, _, err := parse(src, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tree.imports[0]
+	if a.importPath != "example.com/m/a" || !reflect.DeepEqual(a.goFileNames, []string{"a.go"}) ||
+		!reflect.DeepEqual(a.assemblyFileNames, []string{"a_asm.s"}) {
+		t.Fatalf("unexpected package loaded from memory: %s %v %v", a.importPath, a.goFileNames, a.assemblyFileNames)
+	}
+}
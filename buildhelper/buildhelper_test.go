@@ -1,33 +1,1312 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"go/build"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRun(t *testing.T) {
+	// Run exits the process on errors, so it only runs with an input to build
+	if _, err := os.Stat("main.go"); err != nil {
+		t.Skip("no main.go to build:", err)
+	}
 	tdir := "/tmp/go-buildhelper-253235"
 	err := os.Mkdir(tdir, 0700)
 	if err != nil && !os.IsExist(err) {
 		t.Fatal(err)
 	}
 	if true { // Test cross-compilation (requires compiling most of the standard library from source)
-		// It builds properly but warns when linking: Cgo is not implemented as it can't be ("easily") implemented for the web
+		// Cgo is not implemented as it can't be ("easily") implemented for the web, so the !cgo fallbacks are used
+		defer func(ctx build.Context) { build.Default = ctx }(build.Default)
 		build.Default.GOOS = "android"
 		build.Default.GOARCH = "amd64"
-		err = os.Setenv("GOOS", build.Default.GOOS)
+		for key, value := range map[string]string{"GOOS": build.Default.GOOS, "GOARCH": build.Default.GOARCH, "CGO_ENABLED": "0"} {
+			if previous, ok := os.LookupEnv(key); ok {
+				defer os.Setenv(key, previous)
+			} else {
+				defer os.Unsetenv(key)
+			}
+			if err = os.Setenv(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	Run("main.go", tdir, []string{"example"}, runOptions{})
+}
+
+// writeTestTree writes the given files (relative path -> contents) to a new temporary directory and returns it.
+// The caller must remove the directory.
+func writeTestTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "go-buildhelper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPlanDependencies(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":      "module example.com/m\n",
+		"main.go":     "package main\n\nimport (\n\t\"example.com/m/a\"\n\t\"example.com/m/b\"\n)\n\nfunc main() { a.A(); b.B() }\n",
+		"a/a.go":      "package a\n\nimport \"example.com/m/b\"\n\nfunc A() { b.B() }\n",
+		"b/b.go":      "package b\n\nfunc B() {}\n",
+		"b/b_test.go": "package b\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	srcs := newSources()
+	tree, precompiledInternal, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importCfg, actions, linkPackages, err := compile(tree, buildDir, precompiledInternal, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions = link(importCfg, linkPackages, actions, buildDir, "")
+	deps := map[string][]string{}
+	for i, a := range actions {
+		for _, dep := range a.Deps {
+			if _, ok := deps[dep]; !ok {
+				t.Fatalf("action %d (%s) is listed before its dependency %s", i, a.ID, dep)
+			}
+		}
+		deps[a.ID] = a.Deps
+	}
+	expected := map[string][]string{
+		"compile example.com/m/b": {},
+		"compile example.com/m/a": {"compile example.com/m/b"},
+		"compile main":            {"compile example.com/m/a", "compile example.com/m/b"},
+		"link":                    {"compile main"},
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("unexpected plan dependencies:\n%v\nexpected:\n%v", deps, expected)
+	}
+}
+
+func TestActionIDsFollowContents(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nimport \"example.com/m/b\"\n\nfunc main() { b.B() }\n",
+		"b/b.go":  "package b\n\nfunc B() {}\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	srcs := newSources()
+	actionIDs := func() (string, string) {
+		tree, precompiledInternal, err := parse(src, srcs, build.Default)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = compile(tree, buildDir, precompiledInternal, srcs, build.Default); err != nil {
+			t.Fatal(err)
+		}
+		return tree.actionID, tree.imports[0].actionID
+	}
+	mainID, bID := actionIDs()
+	// Touching a file without changing its contents keeps the IDs
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "b", "b.go"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if mainID2, bID2 := actionIDs(); mainID2 != mainID || bID2 != bID {
+		t.Fatal("action IDs changed without changing any source")
+	}
+	// Changing a dependency changes the IDs of the dependency and its dependents
+	err := ioutil.WriteFile(filepath.Join(src, "b", "b.go"), []byte("package b\n\nfunc B() { println() }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mainID2, bID2 := actionIDs(); mainID2 == mainID || bID2 == bID {
+		t.Fatal("action IDs did not change after modifying a dependency")
+	}
+	// The same sources in another directory have other positions
+	mainID, _ = actionIDs()
+	moved := src + "_moved"
+	if err = os.Rename(src, moved); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	src = moved
+	if mainID2, _ := actionIDs(); mainID2 == mainID {
+		t.Fatal("action IDs did not change after moving the sources")
+	}
+}
+
+func TestIncompleteCachedArchive(t *testing.T) {
+	cache := writeTestTree(t, nil)
+	defer os.RemoveAll(cache)
+	if err := os.Setenv("BUILDHELPER_CACHE", cache); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("BUILDHELPER_CACHE")
+	member := func(name, contents string) string {
+		header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 0, 0, 0, 0644, len(contents))
+		if len(contents)%2 == 1 {
+			contents += "\n"
+		}
+		return header + contents
+	}
+	archive := "!<arch>\n" + member("__.PKGDEF", "go object\n") + member("_go_.o", "object")
+	for _, c := range []struct {
+		contents      string
+		assemblyFiles int
+		cached        bool
+	}{
+		{archive, 0, true},
+		{archive[:len(archive)-1], 0, false}, // Truncated
+		{archive, 1, false},                  // Not packed
+		{archive + member("a.o", "asm"), 1, true},
+	} {
+		if err := ioutil.WriteFile(pkgArchiveCacheFor("id", cache), []byte(c.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if cached := checkCachedArchive("id", c.assemblyFiles) != ""; cached != c.cached {
+			t.Fatalf("archive of %d bytes with %d assembly files: cached = %v", len(c.contents), c.assemblyFiles, cached)
+		}
+	}
+}
+
+func TestResolveEmbedPatterns(t *testing.T) {
+	pkgDir := writeTestTree(t, map[string]string{
+		"main.go":          "package main\n",
+		"static/a.txt":     "a",
+		"static/_b.txt":    "b",
+		"static/sub/c.txt": "c",
+		"empty/.keep":      "",
+		"nested/go.mod":    "module example.com/nested\n",
+		"nested/d.txt":     "d",
+		"version.txt":      "1",
+	})
+	defer os.RemoveAll(pkgDir)
+	srcs := newSources()
+	for pattern, expected := range map[string][]string{
+		"static":        {"static/a.txt", "static/sub/c.txt"},
+		"all:static":    {"static/_b.txt", "static/a.txt", "static/sub/c.txt"},
+		"static/_b.txt": {"static/_b.txt"},
+		"*.txt":         {"version.txt"},
+	} {
+		files, err := resolveEmbedPattern(pkgDir, pattern, srcs)
+		if err != nil {
+			t.Fatal(pattern, err)
+		}
+		if !reflect.DeepEqual(files, expected) {
+			t.Fatalf("pattern %s matched %v, expected %v", pattern, files, expected)
+		}
+	}
+	for _, pattern := range []string{"../main.go", "/static", "static/", "./static", "missing*", "empty", "nested", "nested/d.txt"} {
+		if files, err := resolveEmbedPattern(pkgDir, pattern, srcs); err == nil {
+			t.Fatalf("pattern %s should be rejected, but matched %v", pattern, files)
+		}
+	}
+}
+
+func TestParseTest(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":    "module example.com/m\n",
+		"m.go":      "package m\n\nfunc F() int { return 1 }\n",
+		"m_test.go": "package m\n\nimport \"testing\"\n\nfunc TestF(t *testing.T) {}\n\nfunc Testlower(t *testing.T) {}\n",
+		"x_test.go": "package m_test\n\nimport (\n\t\"fmt\"\n\t\"testing\"\n\n\t\"example.com/m\"\n)\n\n" +
+			"func BenchmarkF(b *testing.B) {}\n\nfunc ExampleF() {\n\tfmt.Println(m.F())\n\t// Output: 1\n}\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	srcs := newSources()
+	tree, _, err := parseTest(src, buildDir, srcs, build.Default, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var importPaths []string
+	for _, dep := range tree.imports {
+		if dep.importPath == "example.com/m" || dep.importPath == "example.com/m_test" {
+			importPaths = append(importPaths, dep.importPath)
+		}
+	}
+	if !reflect.DeepEqual(importPaths, []string{"example.com/m", "example.com/m_test"}) {
+		t.Fatal("the test main package does not import the test packages:", importPaths)
+	}
+	testMain, err := ioutil.ReadFile(filepath.Join(buildDir, "_testmain", "_testmain.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`{ "TestF", _test.TestF }`, `{ "BenchmarkF", _xtest.BenchmarkF }`,
+		`{ "ExampleF", _xtest.ExampleF, "1\n", false }`} {
+		if !strings.Contains(string(testMain), expected) {
+			t.Fatalf("generated test main does not contain %s:\n%s", expected, testMain)
+		}
+	}
+	if strings.Contains(string(testMain), "Testlower") {
+		t.Fatal("Testlower is not a test function")
+	}
+}
+
+func TestTest2JSONExecution(t *testing.T) {
+	if testing.Short() {
+		t.Skip("executes the plan, compiling the standard library on the first run")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to execute the plan:", err)
+	}
+	src := writeTestTree(t, map[string]string{
+		"go.mod": "module example.com/m\n",
+		"m.go":   "package m\n",
+		"m_test.go": "package m\n\nimport (\n\t\"os\"\n\t\"testing\"\n)\n\nfunc TestMain(m *testing.M) { os.Exit(m.Run()) }\n\n" +
+			"func TestPass(t *testing.T) { t.Log(\"passing\") }\n\nfunc TestFail(t *testing.T) { t.Error(\"failing\") }\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	if err := os.Setenv("ALSO_EXECUTE_COMMANDS", "1"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("ALSO_EXECUTE_COMMANDS")
+	// Like Run with -test -test2json, for the host
+	ctx, err := newBuildContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := newSources()
+	tree, precompiledInternal, err := parseTest(src, buildDir, srcs, ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(cacheDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	importCfg, actions, targets, err := compilePackages([]*parsedTreeNode{tree}, buildDir, precompiledInternal, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions = link(importCfg, targets[0].packages, actions, buildDir, defaultGoDebug(tree, srcs, ctx))
+	for _, a := range actions {
+		a.Env = subArchSettings(ctx)
+	}
+	output(actions, buildDir, srcs, false)
+	for run, expected := range map[string]struct {
+		exitCode int
+		events   []string
+	}{
+		"TestPass":          {0, []string{"run TestPass", "pass TestPass", "pass "}},
+		"TestPass|TestFail": {1, []string{"run TestPass", "pass TestPass", "run TestFail", "fail TestFail", "fail "}},
+	} {
+		cmd := exec.Command(filepath.Join(buildDir, "a.out"), "-test.run", run)
+		out, err := cmd.Output()
+		exitCode := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			var event struct{ Action, Package, Test, Output string }
+			if err = json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("-test.run %s: invalid test2json event %q: %v", run, line, err)
+			}
+			if event.Package != "example.com/m" {
+				t.Fatalf("-test.run %s: unexpected package of event %q", run, line)
+			}
+			if event.Action != "output" {
+				events = append(events, event.Action+" "+event.Test)
+			}
+		}
+		if exitCode != expected.exitCode || !reflect.DeepEqual(events, expected.events) {
+			t.Fatalf("-test.run %s: exit code %d and events %q, expected %d and %q", run, exitCode, events,
+				expected.exitCode, expected.events)
+		}
+	}
+}
+
+func TestWorkspaceImports(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.work":           "go 1.18\n\nuse (\n\t./app\n\t./lib\n\t./lib/nested\n)\n\nreplace example.com/other => ./other\n",
+		"app/go.mod":        "module example.com/app\n",
+		"app/main.go":       "package main\n",
+		"lib/go.mod":        "module example.com/lib\n",
+		"lib/util/util.go":  "package util\n",
+		"lib/nested/go.mod": "module example.com/lib/nested\n",
+		"lib/nested/n.go":   "package nested\n",
+		"other/other.go":    "package other\n",
+		"invalid.work":      "go 1.18\n\nuse ./app\nunknown\n",
+	})
+	defer os.RemoveAll(src)
+	appDir := filepath.Join(src, "app")
+	srcs := newSources()
+	for importPath, expected := range map[string]string{
+		"example.com/lib/util":   filepath.Join(src, "lib", "util"),
+		"example.com/lib/nested": filepath.Join(src, "lib", "nested"),
+		"example.com/other":      filepath.Join(src, "other"),
+	} {
+		if dir, _, _, _ := parseFindDirForImport(importPath, appDir, "", srcs, build.Default); dir != expected {
+			t.Fatalf("import %s resolved to %q, expected %q", importPath, dir, expected)
+		}
+	}
+	invalid := newSources()
+	invalid.addOverlay(filepath.Join(src, "go.work"), filepath.Join(src, "invalid.work"))
+	if _, _, err := parse(appDir, invalid, build.Default); err == nil || !strings.Contains(err.Error(), "errors parsing go.work") {
+		t.Fatal("expected an invalid go.work file to fail the build, got", err)
+	}
+	if err := os.Setenv("GOWORK", "off"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GOWORK")
+	if dir, _, _, _ := parseFindDirForImport("example.com/lib/util", appDir, "", srcs, build.Default); dir != "" {
+		t.Fatal("GOWORK=off must disable workspace resolution, but resolved to", dir)
+	}
+}
+
+func TestModuleProxyImports(t *testing.T) {
+	proxy := writeTestTree(t, map[string]string{
+		"example.com/a/@v/v1.0.0.mod": "module example.com/a\n\nrequire example.com/b v1.1.0\n",
+		"example.com/b/@v/v1.0.0.mod": "module example.com/b\n",
+		"example.com/b/@v/v1.1.0.mod": "module example.com/b\n",
+		"example.com/c/@v/v1.0.0.mod": "module example.com/c\n",
+		"example.com/d/@v/v1.0.0.mod": "module example.com/d\n",
+	})
+	defer os.RemoveAll(proxy)
+	goSum := ""
+	for m, files := range map[module.Version]map[string]string{
+		{Path: "example.com/a", Version: "v1.0.0"}: {"go.mod": "module example.com/a\n", "a.go": "package a\n"},
+		{Path: "example.com/b", Version: "v1.1.0"}: {"go.mod": "module example.com/b\n", "sub/b.go": "package sub\n"},
+		{Path: "example.com/c", Version: "v1.0.0"}: {"go.mod": "module example.com/c\n", "c.go": "package c\n"},
+		{Path: "example.com/d", Version: "v1.0.0"}: {"go.mod": "module example.com/d\n", "d.go": "package d\n"},
+	} {
+		var zipFiles []modzip.File
+		for name, contents := range files {
+			zipFiles = append(zipFiles, testZipFile{name, contents})
+		}
+		zipFile, err := os.Create(filepath.Join(proxy, m.Path, "@v", m.Version+".zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = modzip.Create(zipFile, m, zipFiles)
+		_ = zipFile.Close()
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = os.Setenv("GOARCH", build.Default.GOARCH)
+		sum, err := dirhash.HashZip(zipFile.Name(), dirhash.Hash1)
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = os.Setenv("CGOENABLED", "1")
+		switch m.Path {
+		case "example.com/c":
+			sum = "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" // Tampered zip
+		case "example.com/d":
+			continue // Missing go.sum entry
+		}
+		goSum += m.Path + " " + m.Version + " " + sum + "\n"
+	}
+	src := writeTestTree(t, map[string]string{
+		"go.mod": "module example.com/m\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v1.0.0\n" +
+			"\texample.com/c v1.0.0\n\texample.com/d v1.0.0\n)\n",
+		"go.sum":  goSum,
+		"main.go": "package main\n",
+	})
+	defer os.RemoveAll(src)
+	modCache := writeTestTree(t, nil)
+	defer os.RemoveAll(modCache)
+	for key, value := range map[string]string{"GOMODCACHE": modCache, "GOPROXY": "file://" + filepath.ToSlash(proxy)} {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(key)
+	}
+	srcs := newSources()
+	for importPath, expected := range map[string]string{
+		"example.com/a":     filepath.Join(modCache, "example.com", "a@v1.0.0"),
+		"example.com/b/sub": filepath.Join(modCache, "example.com", "b@v1.1.0", "sub"), // Selected by MVS
+	} {
+		if dir, _, _, _ := parseFindDirForImport(importPath, src, "", srcs, build.Default); dir != expected {
+			t.Fatalf("import %s resolved to %q, expected %q", importPath, dir, expected)
+		}
+	}
+	for importPath, expected := range map[string]string{
+		"example.com/c": "verifying example.com/c@v1.0.0: checksum mismatch",
+		"example.com/d": "verifying example.com/d@v1.0.0: missing go.sum entry",
+	} {
+		if _, _, _, err := parseFindDirForImport(importPath, src, "", srcs, build.Default); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("import %s: expected error containing %q, got %v", importPath, expected, err)
+		}
+	}
+}
+
+// testZipFile is an in-memory file of a module zip.
+type testZipFile struct {
+	name, contents string
+}
+
+func (f testZipFile) Path() string                { return f.name }
+func (f testZipFile) Lstat() (os.FileInfo, error) { return testZipFileInfo(f), nil }
+func (f testZipFile) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(f.contents)), nil
+}
+
+type testZipFileInfo testZipFile
+
+func (fi testZipFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi testZipFileInfo) Size() int64        { return int64(len(fi.contents)) }
+func (fi testZipFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi testZipFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi testZipFileInfo) IsDir() bool        { return false }
+func (fi testZipFileInfo) Sys() interface{}   { return nil }
+
+func TestVendorConsistency(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.17\n\nrequire example.com/a v1.1.0\n",
+		"main.go": "package main\n",
+		"vendor/modules.txt": "# example.com/a v1.0.0\n## explicit; go 1.17\nexample.com/a\n" +
+			"# example.com/b v1.0.0 => ../b\n## explicit\n",
+		"vendor/example.com/a/a.go": "package a\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	err := checkVendorConsistency(src, srcs)
+	if err == nil {
+		t.Fatal("stale vendor/modules.txt not detected")
+	}
+	for _, expected := range []string{
+		"example.com/a@v1.1.0: is explicitly required in go.mod, but not marked as explicit in vendor/modules.txt",
+		"example.com/a@v1.0.0: is marked as explicit in vendor/modules.txt, but not explicitly required in go.mod",
+		"example.com/b@v1.0.0: is marked as replaced in vendor/modules.txt, but not replaced in go.mod",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("inconsistent vendoring report does not contain %q:\n%v", expected, err)
+		}
+	}
+	if dir := vendorModulesForDir(src, srcs).findDirForImport("example.com/a"); dir != filepath.Join(src, "vendor", "example.com", "a") {
+		t.Fatal("vendored package resolved to", dir)
+	}
+}
+
+func TestReplaceDirectives(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"app/go.mod": "module example.com/app\n\nrequire (\n\texample.com/lib v0.0.0\n\texample.com/old v1.0.0\n)\n\n" +
+			"replace example.com/lib => ../lib\n\nreplace example.com/old v1.0.0 => ./third_party/old\n\nreplace example.com/old v1.1.0 => ./missing\n",
+		"app/main.go":                "package main\n",
+		"app/tools/go.mod":           "module example.com/app/tools\n",
+		"app/tools/tools.go":         "package tools\n",
+		"app/third_party/old/go.mod": "module example.com/old\n",
+		"app/third_party/old/old.go": "package old\n",
+		"lib/go.mod":                 "module example.com/lib\n",
+		"lib/sub/sub.go":             "package sub\n",
+		"lib/nested/go.mod":          "module example.com/lib/nested\n",
+		"lib/nested/nested.go":       "package nested\n",
+	})
+	defer os.RemoveAll(src)
+	appDir := filepath.Join(src, "app")
+	srcs := newSources()
+	for importPath, expected := range map[string]string{
+		"example.com/lib/sub":    filepath.Join(src, "lib", "sub"),
+		"example.com/old":        filepath.Join(appDir, "third_party", "old"), // Version-specific replacement
+		"example.com/app/tools":  "",                                          // Nested module, not required
+		"example.com/lib/nested": "",                                          // Nested module, not required
+	} {
+		if dir, _, _, _ := parseFindDirForImport(importPath, appDir, "", srcs, build.Default); dir != expected {
+			t.Fatalf("import %s resolved to %q, expected %q", importPath, dir, expected)
+		}
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nimport _ \"example.com/m/a\"\n\nfunc main() {}\n",
+		"a/a.go":  "package a\n\nimport _ \"example.com/m/b\"\n",
+		"b/b.go":  "package b\n\nimport (\n\t_ \"fmt\"\n\t_ \"example.com/m/c\"\n)\n",
+		"c/c.go":  "package c\n\nimport _ \"example.com/m/a\"\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	_, _, err := parse(src, srcs, build.Default)
+	if err == nil {
+		t.Fatal("import cycle not detected")
+	}
+	for _, expected := range []string{
+		"example.com/m/a -> example.com/m/b -> example.com/m/c -> example.com/m/a",
+		"example.com/m/b imports example.com/m/c at " + filepath.Join(src, "b", "b.go") + ":5:4",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("import cycle error does not contain %q:\n%v", expected, err)
+		}
+	}
+}
+
+func TestImportVisibility(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":                 "module example.com/m\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ./lib\n",
+		"internal/a/a.go":        "package a\n",
+		"lib/go.mod":             "module example.com/lib\n",
+		"lib/internal/b/b.go":    "package b\n",
+		"lib/vendor/c/c.go":      "package c\n",
+		"ok/main.go":             "package main\n\nimport _ \"example.com/m/internal/a\"\n\nfunc main() {}\n",
+		"lib_internal/main.go":   "package main\n\nimport _ \"example.com/lib/internal/b\"\n\nfunc main() {}\n",
+		"std_internal/main.go":   "package main\n\nimport _ \"internal/cpu\"\n\nfunc main() {}\n",
+		"vendor_element/main.go": "package main\n\nimport _ \"example.com/lib/vendor/c\"\n\nfunc main() {}\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	if _, _, err := parse(filepath.Join(src, "ok"), srcs, build.Default); err != nil {
+		t.Fatal(err)
+	}
+	for dir, expected := range map[string]string{
+		"lib_internal":   "package example.com/m/lib_internal imports example.com/lib/internal/b: use of internal package",
+		"std_internal":   "package example.com/m/std_internal imports internal/cpu: use of internal package",
+		"vendor_element": "must be imported as c",
+	} {
+		_, _, err := parse(filepath.Join(src, dir), srcs, build.Default)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: expected error containing %q, got %v", dir, expected, err)
+		}
+	}
+}
+
+func TestStdVendorImportMap(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":                     "module example.com/m\n\nrequire golang.org/x/net v0.0.0\n\nreplace golang.org/x/net => ./xnet\n",
+		"main.go":                    "package main\n\nimport (\n\t_ \"golang.org/x/net/dns/dnsmessage\"\n\t_ \"net\"\n)\n\nfunc main() {}\n",
+		"xnet/go.mod":                "module golang.org/x/net\n",
+		"xnet/dns/dnsmessage/msg.go": "package dnsmessage\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	ctx := build.Default
+	ctx.CgoEnabled = false
+	if _, err := os.Stat(filepath.Join(goSrcPath(ctx), "vendor", "golang.org", "x", "net", "dns", "dnsmessage")); err != nil {
+		t.Skip("the standard library does not vendor golang.org/x/net/dns/dnsmessage")
+	}
+	srcs := newSources()
+	tree, precompiledInternal, err := parse(src, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if precompiledInternal {
+		t.Skip("the standard library is precompiled")
+	}
+	importCfg, actions, _, err := compile(tree, buildDir, precompiledInternal, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedCfg, err := ioutil.ReadFile(importCfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"packagefile golang.org/x/net/dns/dnsmessage=", "packagefile vendor/golang.org/x/net/dns/dnsmessage="} {
+		if strings.Count(string(sharedCfg), expected) != 1 {
+			t.Fatalf("expected one %q line in the shared importcfg:\n%s", expected, sharedCfg)
+		}
+	}
+	if strings.Contains(string(sharedCfg), "importmap") {
+		t.Fatalf("unexpected importmap lines in the shared importcfg:\n%s", sharedCfg)
+	}
+	for _, a := range actions {
+		if a.ID != "compile net" {
+			continue
+		}
+		netCfg, err := ioutil.ReadFile(a.Command[indexOf(a.Command, "-importcfg")+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(netCfg), "importmap golang.org/x/net/dns/dnsmessage=vendor/golang.org/x/net/dns/dnsmessage\n") {
+			t.Fatalf("missing importmap line in the importcfg of net:\n%s", netCfg)
+		}
+		return
+	}
+	t.Fatal("net is not compiled")
+}
+
+func TestGopathMode(t *testing.T) {
+	root := writeTestTree(t, map[string]string{
+		"gp1/src/example.com/app/go.mod":                        "module example.com/ignored\n", // Ignored with GO111MODULE=off
+		"gp1/src/example.com/app/main.go":                       "package main\n\nimport (\n\t_ \"example.com/dep\"\n\t_ \"example.com/lib\"\n)\n",
+		"gp1/src/example.com/app/vendor/example.com/dep/dep.go": "package dep\n",
+		"gp2/src/example.com/lib/lib.go":                        "package lib\n\nimport _ \"example.com/dep\"\n",
+		"gp2/src/example.com/dep/dep.go":                        "package dep\n",
+	})
+	defer os.RemoveAll(root)
+	if err := os.Setenv("GO111MODULE", "off"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("GO111MODULE")
+	ctx := build.Default
+	ctx.GOPATH = filepath.Join(root, "gp1") + string(filepath.ListSeparator) + filepath.Join(root, "gp2")
+	appDir := filepath.Join(root, "gp1", "src", "example.com", "app")
+	srcs := newSources()
+	if importPath := importPathForDir(appDir, srcs, ctx); importPath != "example.com/app" {
+		t.Fatalf("import path of %s is %q", appDir, importPath)
+	}
+	tree, _, err := parse(appDir, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]string{} // Actual import path by directory
+	for _, node := range tree.imports {
+		paths[node.dir] = node.importPath
+		for _, dep := range node.imports {
+			paths[dep.dir] = dep.importPath
+		}
+	}
+	for dir, expected := range map[string]string{
+		filepath.Join(appDir, "vendor", "example.com", "dep"):   "example.com/app/vendor/example.com/dep",
+		filepath.Join(root, "gp2", "src", "example.com", "lib"): "example.com/lib",
+		filepath.Join(root, "gp2", "src", "example.com", "dep"): "example.com/dep", // Not visible to lib
+	} {
+		if paths[dir] != expected {
+			t.Fatalf("package at %s has import path %q, expected %q (parsed %v)", dir, paths[dir], expected, paths)
+		}
+	}
+	if mapped := tree.importMap["example.com/dep"]; mapped != "example.com/app/vendor/example.com/dep" {
+		t.Fatalf("example.com/dep is mapped to %q by the main package", mapped)
+	}
+}
+
+func TestEditedStdLibrary(t *testing.T) {
+	ctx := build.Default
+	ctx.CgoEnabled = false
+	pkgDir := filepath.Join("pkg", ctx.GOOS+"_"+ctx.GOARCH)
+	goRoot := writeTestTree(t, map[string]string{
+		"VERSION":                       "go1.20\n",
+		"src/base/base.go":              "package base\n",
+		"src/mid/mid.go":                "package mid\n\nimport _ \"base\"\n",
+		"src/top/top.go":                "package top\n",
+		filepath.Join(pkgDir, "base.a"): "",
+		filepath.Join(pkgDir, "mid.a"):  "",
+		filepath.Join(pkgDir, "top.a"):  "",
+	})
+	defer os.RemoveAll(goRoot)
+	ctx.GOROOT = goRoot
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nimport (\n\t_ \"mid\"\n\t_ \"top\"\n)\n\nfunc main() {}\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	if err := writeStdManifest(srcs, ctx); err != nil {
+		t.Fatal(err)
+	}
+	tree, precompiledInternal, err := parse(src, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !precompiledInternal || len(tree.imports) != 0 {
+		t.Fatalf("expected only precompiled imports, got %d parsed imports", len(tree.imports))
+	}
+	if err = ioutil.WriteFile(filepath.Join(goRoot, "src", "base", "base.go"), []byte("package base\n\nvar Edited bool\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if tree, _, err = parse(src, newSources(), ctx); err != nil { // Like a new run
+		t.Fatal(err)
+	}
+	if len(tree.imports) != 1 || tree.imports[0].importPath != "mid" || tree.imports[0].validPrecompiledArchivePath != "" {
+		t.Fatalf("expected the importer of the edited package to be compiled from sources, got %d parsed imports", len(tree.imports))
+	}
+	if base := tree.imports[0].imports; len(base) != 1 || base[0].importPath != "base" || base[0].validPrecompiledArchivePath != "" {
+		t.Fatal("expected the edited package to be compiled from sources")
+	}
+}
+
+func TestInputFiles(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":     "module example.com/m\n",
+		"gen.go":     "//go:build ignore\n// +build ignore\n\npackage main\n\nfunc main() { helper() }\n",
+		"helper.go":  "//go:build ignore\n// +build ignore\n\npackage main\n\nimport _ \"example.com/m/a\"\n\nfunc helper() {}\n",
+		"other.go":   "package main\n\nfunc main() {}\n",
+		"lib.go":     "package lib\n",
+		"a/a.go":     "package a\n",
+		"a/a_x.go":   "//go:build ignore\n// +build ignore\n\npackage a\n",
+		"sub/sub.go": "package main\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	srcs.moreInputFiles = []string{filepath.Join(src, "helper.go")}
+	tree, _, err := parse(filepath.Join(src, "gen.go"), srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tree.goFileNames)
+	if expected := []string{"gen.go", "helper.go"}; !reflect.DeepEqual(tree.goFileNames, expected) {
+		t.Fatalf("unexpected files %v (expected %v)", tree.goFileNames, expected)
+	}
+	if len(tree.imports) != 1 || !reflect.DeepEqual(tree.imports[0].goFileNames, []string{"a.go"}) {
+		t.Fatalf("unexpected imports %+v: the constraints of imported packages still apply", tree.imports)
+	}
+	for file, expected := range map[string]string{
+		"lib.go":       "found packages main (gen.go) and lib (lib.go)",
+		"sub/sub.go":   "named files must all be in one directory",
+		"main_test.go": "cannot build *_test.go files",
+	} {
+		srcs.moreInputFiles = []string{filepath.Join(src, filepath.FromSlash(file))}
+		if _, _, err := parse(filepath.Join(src, "gen.go"), srcs, build.Default); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: expected error containing %q, got %v", file, expected, err)
+		}
+	}
+}
+
+func TestPackagePatterns(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":             "module example.com/m\n",
+		"cmd/a/main.go":      "package main\n\nimport \"example.com/m/lib\"\n\nfunc main() { lib.L() }\n",
+		"cmd/b/v2/main.go":   "package main\n\nimport \"example.com/m/lib\"\n\nfunc main() { lib.L() }\n",
+		"lib/lib.go":         "package lib\n\nfunc L() {}\n",
+		"lib/lib_test.go":    "package lib\n",
+		"testonly/x_test.go": "package testonly\n",
+		"testdata/t/main.go": "package main\n",
+		"_hidden/main.go":    "package main\n",
+		"vendor/v/v.go":      "package v\n",
+		"nested/go.mod":      "module example.com/nested\n",
+		"nested/main.go":     "package main\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	srcs := newSources()
+	if _, _, err := parsePattern(filepath.Join(src, "missing", "..."), srcs, build.Default); err == nil {
+		t.Fatal("expected an error for a pattern without matches")
+	}
+	roots, _, err := parsePattern(filepath.Join(src, "cmd", "..."), srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("expected the 2 main packages of cmd, got %d", len(roots))
+	}
+	roots, precompiledInternal, err := parsePattern(filepath.Join(src, "..."), srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, root := range roots {
+		rel, _ := filepath.Rel(src, root.dir)
+		dirs = append(dirs, filepath.ToSlash(rel)+"="+root.importPath)
+	}
+	if expected := []string{"cmd/a=main", "cmd/b/v2=main", "lib=example.com/m/lib"}; !reflect.DeepEqual(dirs, expected) {
+		t.Fatalf("unexpected matches %v (expected %v)", dirs, expected)
+	}
+	importCfg, actions, targets, err := compilePackages(roots, buildDir, precompiledInternal, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions, err = linkMains(importCfg, targets, actions, buildDir, srcs, build.Default); err != nil {
+		t.Fatal(err)
+	}
+	deps := map[string][]string{}
+	for _, a := range actions {
+		if _, ok := deps[a.ID]; ok {
+			t.Fatalf("duplicate action %s", a.ID)
+		}
+		if strings.HasPrefix(a.ID, "compile example.com/m") || strings.HasPrefix(a.ID, "link") {
+			deps[a.ID] = a.Deps
+		}
+	}
+	expected := map[string][]string{
+		"compile example.com/m/lib":      {},
+		"compile example.com/m/cmd/a":    {"compile example.com/m/lib"},
+		"compile example.com/m/cmd/b/v2": {"compile example.com/m/lib"},
+		"link a":                         {"compile example.com/m/cmd/a"},
+		"link b":                         {"compile example.com/m/cmd/b/v2"},
+	}
+	for id, expectedDeps := range expected {
+		if !reflect.DeepEqual(deps[id], expectedDeps) {
+			t.Fatalf("unexpected dependencies of %s: %v (expected %v)", id, deps[id], expectedDeps)
+		}
+	}
+	if len(deps) != len(expected) {
+		t.Fatalf("unexpected actions %v", deps)
+	}
+}
+
+func TestCgoFiles(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":          "module example.com/m\n",
+		"main.go":         "package main\n\nimport _ \"example.com/m/a\"\n\nfunc main() {}\n",
+		"a/a_cgo.go":      "package a\n\n// int f() { return 1; }\nimport \"C\"\n",
+		"a/a_nocgo.go":    "//go:build !cgo\n// +build !cgo\n\npackage a\n",
+		"a/a_cgo_only.go": "//go:build cgo\n// +build cgo\n\npackage a\n",
+	})
+	defer os.RemoveAll(src)
+	ctx := build.Default
+	ctx.CgoEnabled = false
+	srcs := newSources()
+	tree, _, err := parse(src, srcs, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := tree.imports[0].goFileNames; !reflect.DeepEqual(files, []string{"a_nocgo.go"}) {
+		t.Fatal("unexpected files selected without cgo:", files)
+	}
+	// Without fallback, the skipped files are reported too
+	noFallback := newSources()
+	noFallback.addOverlay(filepath.Join(src, "a", "a_nocgo.go"), "")
+	_, _, err = parse(src, noFallback, ctx)
+	for _, expected := range []string{"example.com/m/a: import \"C\" at a_cgo.go:4", "no Go files left", "!cgo build tag"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("cgo report does not contain %q:\n%v", expected, err)
+		}
+	}
+	ctx.CgoEnabled = true
+	_, _, err = parse(src, srcs, ctx)
+	if err == nil {
+		t.Fatal("files requiring cgo were not reported")
+	}
+	for _, expected := range []string{"example.com/m/a: import \"C\" at a_cgo.go:4", "it uses a_nocgo.go", "CGO_ENABLED=0"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("cgo report does not contain %q:\n%v", expected, err)
+		}
+	}
+	defer os.Setenv("CGO_ENABLED", os.Getenv("CGO_ENABLED"))
+	for value, expected := range map[string]bool{"": false, "0": false, "1": true} {
+		if err = os.Setenv("CGO_ENABLED", value); err != nil {
+			t.Fatal(err)
+		}
+		if enabled := cgoEnabled(); enabled != expected {
+			t.Fatalf("CGO_ENABLED=%q enables cgo: %v, expected %v", value, enabled, expected)
+		}
+	}
+}
+
+func TestToolFlagsFollowVersion(t *testing.T) {
+	goRoot := writeTestTree(t, nil)
+	defer os.RemoveAll(goRoot)
+	ctx := build.Default
+	ctx.GOROOT = goRoot
+	ctx.GOOS, ctx.GOARCH = "linux", "amd64"
+	runtimeNode := &parsedTreeNode{importPath: "runtime", internal: true, assemblyFileNames: []string{"asm.s"}}
+	for version, expected := range map[string][]string{
+		"go1.13.15": {"compile", "-p", "runtime", "-std", "-+", "asm", "-D", "GOOS_linux", "-D", "GOARCH_amd64"},
+		"go1.17.13": {"compile", "-p", "runtime", "-std", "-+", "asm", "-D", "GOOS_linux", "-D", "GOARCH_amd64",
+			"-compiling-runtime"},
+		"go1.19.13": {"compile", "-p", "runtime", "-std", "-+", "asm", "-p", "runtime", "-D", "GOOS_linux", "-D",
+			"GOARCH_amd64", "-compiling-runtime", "-D", "GOAMD64_v1"},
+		"go1.22.0": {"compile", "-p", "runtime", "-lang=go1.22", "-std", "asm", "-p", "runtime", "-D", "GOOS_linux", "-D",
+			"GOARCH_amd64", "-std", "-D", "GOAMD64_v1"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(goRoot, "VERSION"), []byte(version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		srcs := newSources() // The version is read once per run
+		flags := append(append([]string{"compile"}, compileToolFlags(runtimeNode, srcs, ctx)...), "asm")
+		flags = append(flags, asmToolFlags(runtimeNode, srcs, ctx)...)
+		if !reflect.DeepEqual(flags, expected) {
+			t.Fatalf("%s: unexpected tool flags %v, expected %v", version, flags, expected)
+		}
+	}
+	// Without a VERSION file, the version is read from the precompiled runtime archive
+	if err := os.Remove(filepath.Join(goRoot, "VERSION")); err != nil {
+		t.Fatal(err)
+	}
+	runtimeArchive := filepath.Join(goRoot, "pkg", "linux_amd64", "runtime.a")
+	if err := os.MkdirAll(filepath.Dir(runtimeArchive), 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := "!<arch>\n__.PKGDEF       0           0     0     644     100       `\ngo object linux amd64 go1.16.15 X:none\n"
+	if err := ioutil.WriteFile(runtimeArchive, []byte(archive), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if minor := newSources().toolchainMinorVersion(ctx); minor != 16 {
+		t.Fatal("unexpected toolchain version from the precompiled archive:", minor)
+	}
+}
+
+func TestLanguageVersionAndGoDebug(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":     "module example.com/m\n\ngo 1.21\n\ngodebug panicnil=1\n\nrequire example.com/lib v0.0.0\n\nreplace example.com/lib => ./lib\n",
+		"main.go":    "//go:debug http2client=0\n\npackage main\n\nimport _ \"example.com/lib\"\n\nfunc main() {}\n",
+		"lib/go.mod": "module example.com/lib\n\ngo 1.18\n",
+		"lib/lib.go": "package lib\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	tree, _, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang := langFlag(tree.goVersion, srcs, build.Default); lang != "-lang=go1.21" {
+		t.Fatal("unexpected language version of the main module:", lang)
+	}
+	if lang := langFlag(tree.imports[0].goVersion, srcs, build.Default); lang != "-lang=go1.18" {
+		t.Fatal("unexpected language version of a dependency:", lang)
+	}
+	goDebug := "," + defaultGoDebug(tree, srcs, build.Default) + ","
+	for _, expected := range []string{",panicnil=1,", ",http2client=0,", ",httpmuxgo121=1,"} { // The last one changed in 1.22
+		if !strings.Contains(goDebug, expected) {
+			t.Fatalf("default GODEBUG %s does not contain %s", goDebug, expected)
+		}
+	}
+}
+
+func TestSubArchitectureSettings(t *testing.T) {
+	goRoot := writeTestTree(t, map[string]string{
+		"VERSION": "go1.22.0\n",
+		"pkg/linux_arm/runtime.a": "!<arch>\n__.PKGDEF       0           0     0     644     100       `\n" +
+			"go object linux arm go1.22.0 GOARM=7 X:none\n",
+	})
+	defer os.RemoveAll(goRoot)
+	ctx := build.Default
+	ctx.GOROOT = goRoot
+	ctx.GOOS, ctx.GOARCH = "linux", "arm"
+	defer os.Unsetenv("GOARM")
+	if !hasPrecompiledStd(ctx) {
+		t.Fatal("the precompiled standard library was not used for the default variant")
+	}
+	if err := os.Setenv("GOARM", "6"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSubArch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tags := subArchTags(ctx); !reflect.DeepEqual(tags, []string{"arm.5", "arm.6"}) {
+		t.Fatal("unexpected build tags:", tags)
+	}
+	node := &parsedTreeNode{importPath: "example.com/m", assemblyFileNames: []string{"asm.s"}}
+	expected := []string{"-p", "example.com/m", "-D", "GOOS_linux", "-D", "GOARCH_arm", "-D", "GOARM_6", "-D", "GOARM_5"}
+	if flags := asmToolFlags(node, newSources(), ctx); !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("unexpected asm flags %v, expected %v", flags, expected)
+	}
+	if settings := subArchSettings(ctx); !reflect.DeepEqual(settings, []string{"GOARM=6"}) {
+		t.Fatal("unexpected tool environment:", settings)
+	}
+	if hasPrecompiledStd(ctx) {
+		t.Fatal("the precompiled standard library was used for another variant")
+	}
+	if err := os.Setenv("GOARM", "8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSubArch(ctx); err == nil {
+		t.Fatal("an invalid GOARM was accepted")
+	}
+}
+
+func TestZipSources(t *testing.T) {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for name, contents := range map[string]string{
+		"go.mod":       "module example.com/m\n",
+		"main.go":      "package main\n\nimport \"example.com/m/a\"\n\nfunc main() { println(a.Data) }\n",
+		"a/a.go":       "package a\n\nimport _ \"embed\"\n\n//go:embed data/*.txt\nvar Data string\n",
+		"a/a_test.go":  "package a\n",
+		"a/data/x.txt": "x",
+	} {
+		f, err := w.Create(name)
 		if err != nil {
 			t.Fatal(err)
 		}
+		if _, err = f.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := writeTestTree(t, nil)
+	defer os.RemoveAll(tmp)
+	src := filepath.Join(tmp, "src") // Not extracted
+	srcs := newSources()
+	if err = srcs.mount(src, newZipFS(r)); err != nil {
+		t.Fatal(err)
+	}
+	tree, precompiledInternal, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tree.imports[0]
+	if !reflect.DeepEqual(a.goFileNames, []string{"a.go"}) || a.embedCfg == nil || a.embedCfg.Files["data/x.txt"] == "" {
+		t.Fatalf("unexpected package loaded from the archive: %v %v", a.goFileNames, a.embedCfg)
+	}
+	buildDir := filepath.Join(tmp, "build")
+	if err = os.Mkdir(buildDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, actions, _, err := compile(tree, buildDir, precompiledInternal, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srcs.extractMountedInputs(actions); err != nil {
+		t.Fatal(err)
+	}
+	for name, extracted := range map[string]bool{"main.go": true, "a/a.go": true, "a/data/x.txt": true,
+		"a/a_test.go": false, "go.mod": false} {
+		if _, err = os.Stat(filepath.Join(src, filepath.FromSlash(name))); (err == nil) != extracted {
+			t.Fatalf("%s: extracted = %v, expected %v", name, err == nil, extracted)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":     "module example.com/m\n",
+		"main.go":    "package main\n\nfunc main() {}\n",
+		"a/a.go":     "package a\n",
+		"a/a_old.go": "package a\n\nimport \"does/not/exist\"\n",
+	})
+	defer os.RemoveAll(src)
+	replacements := writeTestTree(t, map[string]string{
+		"main.go": "package main\n\nimport \"example.com/m/a\"\n\nfunc main() { a.A() }\n",
+		"b.go":    "package a\n\nfunc A() {}\n",
+	})
+	defer os.RemoveAll(replacements)
+	overlay := fmt.Sprintf(`{"Replace": {%q: %q, %q: %q, %q: ""}}`,
+		filepath.Join(src, "main.go"), filepath.Join(replacements, "main.go"),
+		filepath.Join(src, "a", "b.go"), filepath.Join(replacements, "b.go"),
+		filepath.Join(src, "a", "a_old.go"))
+	overlayFile := filepath.Join(replacements, "overlay.json")
+	if err := ioutil.WriteFile(overlayFile, []byte(overlay), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcs := newSources()
+	if err := srcs.loadOverlay(overlayFile); err != nil {
+		t.Fatal(err)
+	}
+	tree, precompiledInternal, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.imports) != 1 || len(tree.imports[0].goFileNames) != 2 {
+		t.Fatalf("the overlay was not applied while parsing: %v", tree.imports)
+	}
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	_, actions, _, err := compile(tree, buildDir, precompiledInternal, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileMain := actions[len(actions)-1].Command
+	compiledFile := compileMain[len(compileMain)-1]
+	contents, err := ioutil.ReadFile(compiledFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(contents), "//line "+filepath.Join(src, "main.go")+":1:1\npackage main\n") {
+		t.Fatalf("unexpected compiled file %s:\n%s", compiledFile, contents)
+	}
+	if original, _ := ioutil.ReadFile(filepath.Join(src, "main.go")); string(original) != "package main\n\nfunc main() {}\n" {
+		t.Fatal("the overlaid file was modified")
+	}
+}
+
+func TestRemoveOverlay(t *testing.T) {
+	srcs := newSources()
+	root := filepath.Join(os.TempDir(), "overlay-root")
+	kept, removed := filepath.Join(root, "a", "a.go"), filepath.Join(root, "b", "c", "c.go")
+	srcs.addOverlay(kept, "")
+	srcs.addOverlay(removed, "")
+	srcs.removeOverlay(removed)
+	for _, dir := range []string{filepath.Join(root, "b", "c"), filepath.Join(root, "b")} {
+		if entries, ok := srcs.overlayDirs[dir]; ok {
+			t.Fatalf("the now-empty overlaid directory %s was not pruned: %v", dir, entries)
+		}
+	}
+	if !reflect.DeepEqual(srcs.overlayDirs[root], map[string]bool{"a": true}) {
+		t.Fatal("unexpected overlaid entries of the parent directory:", srcs.overlayDirs[root])
+	}
+	srcs.removeOverlay(kept)
+	if len(srcs.overlayDirs) != 0 {
+		t.Fatal("overlaid directories left after removing all overlays:", srcs.overlayDirs)
+	}
+}
+
+func TestInstrumentation(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "//go:build !never\n\npackage main\n\nimport \"os\"\n\nfunc main() { os.Exit(0) }\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	hostCtx := build.Default
+	hostCtx.GOOS = "linux"
+	srcs := newSources()
+	if err := instrumentMain(src, buildDir, []string{"stop"}, srcs, hostCtx); err == nil {
+		t.Fatal("the stop hook was accepted for a target other than js")
+	}
+	if err := instrumentMain(src, buildDir, []string{"panicjson", "flush"}, srcs, build.Default); err != nil {
+		t.Fatal(err)
+	}
+	tree, _, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexOf(tree.goFileNames, instrumentationFileName) < 0 {
+		t.Fatalf("the instrumentation was not added to the main package: %v", tree.goFileNames)
+	}
+	imported := map[string]bool{}
+	for _, imp := range tree.imports {
+		imported[imp.importPath] = true
+	}
+	if !imported["encoding/json"] || !imported["os"] {
+		t.Fatalf("the imports of the instrumentation were not parsed: %v", imported)
+	}
+	compiled, err := srcs.overlayCompileFile(filepath.Join(src, "main.go"), buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "//line " + filepath.Join(src, "main.go") + ":1:1\n//go:build !never\n\npackage main\n\nimport \"os\"\n\n" +
+		"func buildhelperUserMain/*line " + filepath.Join(src, "main.go") + ":7:10*/() { os.Exit(0) }\n"
+	if string(contents) != expected {
+		t.Fatalf("unexpected instrumented main file:\n%s", contents)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nimport (\n\t\"fmt\"\n\t\"example.com/m/missing\"\n)\n\nfunc main() {}\n",
+	})
+	defer os.RemoveAll(src)
+	srcs := newSources()
+	_, _, err := parse(src, srcs, build.Default)
+	if err == nil {
+		t.Fatal("the missing import was not reported")
+	}
+	diagnostics := errorDiagnostics(err, srcs)
+	if len(diagnostics) != 1 || diagnostics[0].File != filepath.Join(src, "main.go") || diagnostics[0].Line != 5 ||
+		diagnostics[0].Column != 2 || diagnostics[0].Package != "main" || diagnostics[0].Source != "buildhelper" {
+		t.Fatalf("unexpected diagnostics of the missing import: %+v", diagnostics)
+	}
+	srcs.overlayCopies["/build/_overlay_x/a.go"] = "/src/a/a.go"
+	output := "/build/_overlay_x/a.go:3:5: cannot use x (variable of type int) as string value\n" +
+		"\thave int\n/src/a/a_amd64.s:7: unrecognized instruction\nasm: assembly failed\n"
+	diagnostics = toolDiagnostics(&action{Command: []string{"compile"}, Package: "example.com/m/a"}, output, srcs)
+	expected := []diagnostic{
+		{"example.com/m/a", "/src/a/a.go", 3, 5, "error", "cannot use x (variable of type int) as string value\n\thave int",
+			"compile"},
+		{"example.com/m/a", "/src/a/a_amd64.s", 7, 0, "error", "unrecognized instruction", "compile"},
+		{"example.com/m/a", "", 0, 0, "error", "asm: assembly failed", "compile"},
+	}
+	if !reflect.DeepEqual(diagnostics, expected) {
+		t.Fatalf("unexpected diagnostics of the tool output:\n%+v\nexpected:\n%+v", diagnostics, expected)
+	}
+}
+
+func TestCheckPackages(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nimport \"example.com/m/a\"\n\nfunc main() { var x int = a.A(); _ = x }\n",
+		"a/a.go":  "package a\n\nfunc A() string { return 1 }\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	srcs := newSources()
+	tree, precompiledInternal, err := parse(src, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importCfg, _, _, err := compile(tree, buildDir, precompiledInternal, srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnostics, err := checkPackages([]*parsedTreeNode{tree}, importCfg.Name(), srcs, build.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, d := range diagnostics {
+		found = append(found, fmt.Sprintf("%s %s:%d:%d", d.Package, filepath.Base(d.File), d.Line, d.Column))
+	}
+	expected := []string{"example.com/m/a a.go:3:26", "main main.go:5:27"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("unexpected type errors %v (expected %v): %+v", found, expected, diagnostics)
+	}
+}
+
+func TestLanguageServer(t *testing.T) {
+	src := writeTestTree(t, map[string]string{
+		"go.mod":  "module example.com/m\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+		"a/a.go":  "package a\n\ntype T struct{ Name string }\n\n// New returns a T.\nfunc New() *T { return &T{} }\n\nfunc (t *T) Hello() string { return t.Name }\n",
+	})
+	defer os.RemoveAll(src)
+	buildDir := writeTestTree(t, nil)
+	defer os.RemoveAll(buildDir)
+	uri := pathToURI(filepath.Join(src, "main.go"))
+	position := func(id, method string, line, character int) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"method":%q,"params":{"textDocument":{"uri":%q},`+
+			`"position":{"line":%d,"character":%d},"context":{"includeDeclaration":true}}}`, id, method, uri, line, character)
+	}
+	text := "package main\n\nimport \"example.com/m/a\"\n\nfunc main() {\n\tv := a.New()\n\t_ = v\n}\n"
+	changed := strings.Replace(text, "\t_ = v\n", "\t_ = v.\n", 1)
+	requests := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":%q,"text":%q}}}`, uri, text),
+		position("2", "textDocument/hover", 5, 9),
+		position("3", "textDocument/definition", 5, 9),
+		position("4", "textDocument/references", 5, 9),
+		fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":%q},`+
+			`"contentChanges":[{"text":%q}]}}`, uri, changed),
+		position("5", "textDocument/completion", 6, 7),
+		`{"jsonrpc":"2.0","id":6,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	}
+	var in, out bytes.Buffer
+	for _, request := range requests {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(request), request)
+	}
+	if err := serveLSP(buildDir, build.Default, &in, &out); err != nil {
+		t.Fatal(err)
+	}
+	responses := map[string]string{}
+	for _, message := range strings.Split(out.String(), "Content-Length: ")[1:] {
+		var response struct {
+			ID     json.RawMessage `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(message[strings.Index(message, "\r\n\r\n")+4:]), &response); err != nil {
+			t.Fatal(err)
+		}
+		responses[string(response.ID)] = string(response.Result) + string(response.Error)
+	}
+	checkResponse := func(id string, expected ...string) {
+		for _, e := range expected {
+			if !strings.Contains(responses[id], e) {
+				t.Errorf("response %s does not contain %s: %s", id, e, responses[id])
+			}
+		}
+	}
+	checkResponse("1", `"hoverProvider":true`)
+	checkResponse("2", "func example.com/m/a.New() *example.com/m/a.T", "New returns a T.", `"start":{"line":5,"character":8}`)
+	checkResponse("3", pathToURI(filepath.Join(src, "a", "a.go")), `"start":{"line":5,"character":5}`)
+	checkResponse("4", `"start":{"line":5,"character":5}`, `"start":{"line":5,"character":8}`)
+	checkResponse("5", `"label":"Hello"`, `"label":"Name"`)
+	checkResponse("6", "null")
+	if entries, _ := filepath.Glob(filepath.Join(buildDir, "*")); len(entries) != 1 || filepath.Base(entries[0]) != "_lsp" {
+		t.Fatalf("unexpected entries left in the build directory: %v (only the open documents are kept)", entries)
 	}
-	Run("main.go", tdir, []string{"example"})
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go/build"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// actionIDVersion must be changed whenever the way archives are generated changes, to invalidate all old cache entries
+const actionIDVersion = "buildhelper-action-1"
+
+// cacheDir returns the directory that stores compiled package archives, shared by all builds (whatever their tags or
+// temporary build directory are), as archives are keyed by their action ID.
+func cacheDir() string {
+	if dir := os.Getenv("BUILDHELPER_CACHE"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "buildhelper-cache")
+}
+
+// actionIDHash computes Go-style action IDs: a hash of everything that may affect the output of an action.
+type actionIDHash struct {
+	h hash.Hash
+}
+
+func newActionIDHash(srcs *sources, buildCtx build.Context) *actionIDHash {
+	h := &actionIDHash{h: sha256.New()}
+	h.add("version", actionIDVersion)
+	h.add("toolchain", srcs.toolchainVersion(buildCtx))
+	h.add("goos", buildCtx.GOOS)
+	h.add("goarch", buildCtx.GOARCH)
+	h.add("subarch", subArchSettings(buildCtx)...)
+	return h
+}
+
+func (h *actionIDHash) add(key string, values ...string) {
+	_, _ = fmt.Fprintf(h.h, "%s %d %q\n", key, len(values), values)
+}
+
+// addFile hashes the name and contents of the given file.
+func (h *actionIDHash) addFile(name, path string, srcs *sources) error {
+	f, err := srcs.open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	contents := sha256.New()
+	if _, err = io.Copy(contents, f); err != nil {
+		return err
+	}
+	h.add("file", name, hex.EncodeToString(contents.Sum(nil)))
+	return nil
+}
+
+func (h *actionIDHash) sum() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+// compileActionID returns the action ID of compiling the given node with the given (output-independent) flags.
+// It depends on the toolchain and target, the flags, the directory and the contents of all source files of the package
+// and the action IDs of all of its dependencies, so a change in any of them invalidates the cached archive. The
+// directory matters as the positions in the archive (for panics, debug information or runtime.Caller) refer to it.
+func compileActionID(node *parsedTreeNode, flags []string, srcs *sources, buildCtx build.Context) (string, error) {
+	h := newActionIDHash(srcs, buildCtx)
+	h.add("importpath", node.importPath)
+	h.add("dir", node.dir)
+	h.add("flags", flags...)
+	if node.embedCfg != nil {
+		// Embedded files are part of the compiled archive
+		var patterns []string
+		for pattern, files := range node.embedCfg.Patterns {
+			patterns = append(patterns, pattern+"="+strings.Join(files, ","))
+		}
+		sort.Strings(patterns)
+		h.add("embed", patterns...)
+		var embedFiles []string
+		for file := range node.embedCfg.Files {
+			embedFiles = append(embedFiles, file)
+		}
+		sort.Strings(embedFiles)
+		for _, file := range embedFiles {
+			if err := h.addFile(file, node.embedCfg.Files[file], srcs); err != nil {
+				return "", err
+			}
+		}
+	}
+	sourceFiles := append(append([]string{}, node.goFileNames...), node.assemblyFileNames...)
+	if len(node.assemblyFileNames) > 0 {
+		headers, err := assemblyHeaderFiles(node.dir, srcs)
+		if err != nil {
+			return "", err
+		}
+		sourceFiles = append(sourceFiles, headers...)
+	}
+	sort.Strings(sourceFiles)
+	for _, name := range sourceFiles {
+		if err := h.addFile(name, filepath.Join(node.dir, name), srcs); err != nil {
+			return "", err
+		}
+	}
+	var deps []string
+	for _, dep := range node.imports {
+		deps = append(deps, dep.importPath+"="+dep.actionID)
+	}
+	sort.Strings(deps)
+	h.add("deps", deps...)
+	return h.sum(), nil
+}
+
+// checkCachedArchive returns the path of the cached archive for the given action ID, if it was already built. The
+// actions write their archive straight to the cache, so a build that was killed midway may leave it truncated, or
+// without the objects of its assembly files (see completeArchive): it is then built again.
+func checkCachedArchive(actionID string, assemblyFiles int) string {
+	archive := pkgArchiveCacheFor(actionID, cacheDir())
+	if stat, err := os.Stat(archive); err != nil || stat.IsDir() {
+		return "" // Not yet built
+	}
+	if !completeArchive(archive, 2+assemblyFiles) {
+		log.Println("Ignoring the incomplete cached archive", archive)
+		return ""
+	}
+	return archive
+}
+
+// completeArchive reports whether the file is a whole ar archive with the given number of members: the compiler writes
+// __.PKGDEF and _go_.o, and pack appends one object per assembly file.
+func completeArchive(archive string, members int) bool {
+	f, err := os.Open(archive)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	magic := make([]byte, len("!<arch>\n"))
+	if _, err = io.ReadFull(f, magic); err != nil || string(magic) != "!<arch>\n" {
+		return false
+	}
+	offset := int64(len(magic))
+	header := make([]byte, 60) // name, mtime, uid, gid, mode, size and terminator
+	for ; members > 0; members-- {
+		if _, err = f.ReadAt(header, offset); err != nil || string(header[58:]) != "`\n" {
+			return false
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return false
+		}
+		offset += int64(len(header)) + size + size%2 // Members are aligned to even offsets
+	}
+	return offset == stat.Size()
+}
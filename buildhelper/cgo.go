@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cgoEnabled returns whether cgo is enabled for the target: only with an explicit CGO_ENABLED=1, as cgo is not supported
+// (unlike go/build, which enables it by default when building for the host). Files that require cgo are then reported
+// by checkCgo, instead of silently selecting their !cgo fallbacks.
+func cgoEnabled() bool {
+	return os.Getenv("CGO_ENABLED") == "1"
+}
+
+// cgoImportPos returns the position of the import "C" of the given file (invalid if it does not use cgo).
+func cgoImportPos(fset *token.FileSet, file *ast.File) token.Position {
+	for _, imp := range file.Imports {
+		if imp.Path.Value == `"C"` {
+			return fset.Position(imp.Path.Pos())
+		}
+	}
+	return token.Position{}
+}
+
+// checkCgo fails with a report of every package and file of the tree that requires cgo, as it is not supported: with
+// CGO_ENABLED=1, every package with files that import "C", and otherwise the packages that skip such files without
+// providing any fallback (like a package whose Go files all require cgo). The standard library always has its
+// fallbacks. For each package, it also lists the files that the package provides as a fallback when cgo is disabled
+// (!cgo).
+func checkCgo(root *parsedTreeNode, srcs *sources, buildCtx build.Context) error {
+	var cgoPackages []*parsedTreeNode
+	fallbacks := map[*parsedTreeNode][]string{}
+	visited := map[*parsedTreeNode]bool{}
+	var visit func(node *parsedTreeNode)
+	visit = func(node *parsedTreeNode) {
+		if visited[node] {
+			return
+		}
+		visited[node] = true
+		if len(node.cgoImports) > 0 {
+			fallbacks[node] = cgoFallbackFiles(node.dir, srcs, buildCtx)
+			if buildCtx.CgoEnabled || (!node.internal && len(fallbacks[node]) == 0) {
+				cgoPackages = append(cgoPackages, node)
+			}
+		}
+		for _, dep := range node.imports {
+			visit(dep)
+		}
+	}
+	visit(root)
+	if len(cgoPackages) == 0 {
+		return nil
+	}
+	sort.Slice(cgoPackages, func(i, j int) bool { return cgoPackages[i].importPath < cgoPackages[j].importPath })
+	report := "cgo is not supported, but CGO_ENABLED=1 selects files that require it:"
+	if !buildCtx.CgoEnabled {
+		report = "cgo is not supported, and packages have no fallback for the files that require it (skipped without cgo):"
+	}
+	allFallbacks := true
+	for _, node := range cgoPackages {
+		var files []string
+		for _, pos := range node.cgoImports {
+			files = append(files, fmt.Sprintf("%s:%d", filepath.Base(pos.Filename), pos.Line))
+		}
+		sort.Strings(files)
+		report += "\n\t" + node.importPath + ": import \"C\" at " + strings.Join(files, ", ")
+		if len(fallbacks[node]) > 0 {
+			report += "\n\t\twithout cgo (!cgo build tag) it uses " + strings.Join(fallbacks[node], ", ")
+		} else {
+			allFallbacks = false
+		}
+		if !buildCtx.CgoEnabled && len(node.goFileNames) == 0 {
+			report += "\n\t\twithout cgo it has no Go files left"
+		}
+	}
+	if !buildCtx.CgoEnabled {
+		report += "\nReplace these packages, or add files with a !cgo build tag that provide what their cgo files do"
+	} else if allFallbacks {
+		report += "\nAll these packages provide !cgo fallbacks: build with CGO_ENABLED=0 instead"
+	} else {
+		report += "\nBuild with CGO_ENABLED=0 to use the !cgo fallbacks, and replace the packages without them"
+	}
+	return errors.New(report)
+}
+
+// cgoFallbackFiles returns the Go files of the package directory that are only selected when cgo is disabled.
+func cgoFallbackFiles(dir string, srcs *sources, buildCtx build.Context) []string {
+	names, err := srcs.readDirNames(dir)
+	if err != nil {
+		return nil
+	}
+	withCgo, withoutCgo := buildCtx, buildCtx
+	withCgo.CgoEnabled = true
+	withoutCgo.CgoEnabled = false
+	var fallbacks []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		matchesWithout, _ := withoutCgo.MatchFile(dir, name)
+		matchesWith, _ := withCgo.MatchFile(dir, name)
+		if matchesWithout && !matchesWith {
+			fallbacks = append(fallbacks, name)
+		}
+	}
+	return fallbacks
+}
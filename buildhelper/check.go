@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packageChecker type-checks packages with go/types (see checkPackages).
+type packageChecker struct {
+	fset        *token.FileSet
+	srcs        *sources
+	buildCtx    build.Context
+	archives    map[string]string // compiled archive of each import path (the packagefile lines of the importcfg)
+	exported    types.Importer    // reads the export data of the archives
+	checked     map[*parsedTreeNode]*types.Package
+	files       map[*parsedTreeNode][]*ast.File // syntax of the packages type-checked from sources
+	info        map[*parsedTreeNode]*types.Info // types of the syntax of the packages type-checked from sources
+	diagnostics []diagnostic
+}
+
+// importerFunc implements types.Importer with a function.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// checkPackages type-checks the packages of the user in the parsed trees (see isUserPackage) with go/types, without
+// compiling anything: their dependencies are imported from the export data of their archives listed in the importcfg
+// file written by compile (cached or precompiled), or type-checked from sources too if they were never compiled. It
+// returns the diagnostics of all errors.
+func checkPackages(roots []*parsedTreeNode, importCfgPath string, srcs *sources, buildCtx build.Context) ([]diagnostic, error) {
+	c, err := newPackageChecker(importCfgPath, srcs, buildCtx)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if _, err = c.load(root); err != nil {
+			return nil, err
+		}
+	}
+	return c.diagnostics, nil
+}
+
+// newPackageChecker returns a checker that imports the archives of the given importcfg file.
+func newPackageChecker(importCfgPath string, srcs *sources, buildCtx build.Context) (*packageChecker, error) {
+	archives, err := readImportCfg(importCfgPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &packageChecker{
+		fset:     token.NewFileSet(),
+		srcs:     srcs,
+		buildCtx: buildCtx,
+		archives: archives,
+		checked:  map[*parsedTreeNode]*types.Package{},
+		files:    map[*parsedTreeNode][]*ast.File{},
+		info:     map[*parsedTreeNode]*types.Info{},
+	}
+	c.exported = importer.ForCompiler(c.fset, "gc", func(path string) (io.ReadCloser, error) {
+		if archive, ok := c.archives[path]; ok {
+			return os.Open(archive)
+		}
+		return nil, fmt.Errorf("no compiled archive for %s", path)
+	})
+	return c, nil
+}
+
+// readImportCfg returns the compiled archive of each package of an importcfg file.
+func readImportCfg(importCfgPath string) (map[string]string, error) {
+	f, err := os.Open(importCfgPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	archives := map[string]string{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if !strings.HasPrefix(lines.Text(), "packagefile ") {
+			continue
+		}
+		spec := strings.TrimPrefix(lines.Text(), "packagefile ")
+		if i := strings.Index(spec, "="); i > 0 {
+			archives[spec[:i]] = spec[i+1:]
+		}
+	}
+	return archives, lines.Err()
+}
+
+// isUserPackage reports whether the package belongs to the user: it is not part of the standard library, the module
+// cache or a vendor directory.
+func isUserPackage(node *parsedTreeNode, buildCtx build.Context) bool {
+	if node.internal {
+		return false
+	}
+	if modCache := goModCache(buildCtx); modCache != "" && strings.HasPrefix(node.dir, modCache+string(filepath.Separator)) {
+		return false
+	}
+	return !strings.Contains(node.dir+string(filepath.Separator), string(filepath.Separator)+"vendor"+string(filepath.Separator))
+}
+
+// load returns the types of a dependency: from the export data of its archive if it is already compiled, or from its
+// sources otherwise. The packages of the user are always type-checked from sources, to report their errors.
+func (c *packageChecker) load(node *parsedTreeNode) (*types.Package, error) {
+	if pkg, ok := c.checked[node]; ok {
+		return pkg, nil
+	}
+	if !isUserPackage(node, c.buildCtx) {
+		if archive := c.archives[node.importPath]; archive != "" {
+			if _, err := os.Stat(archive); err == nil {
+				pkg, err := c.exported.Import(node.importPath)
+				if err == nil {
+					c.checked[node] = pkg
+					return pkg, nil
+				}
+				log.Println("Reading the export data of", node.importPath, "failed, type-checking its sources:", err)
+			}
+		}
+	}
+	return c.check(node)
+}
+
+// check type-checks the sources of a package, recording the errors of the packages of the user as diagnostics.
+func (c *packageChecker) check(node *parsedTreeNode) (*types.Package, error) {
+	isUser := isUserPackage(node, c.buildCtx)
+	var files []*ast.File
+	for _, name := range node.goFileNames {
+		file, err := c.srcs.parseFile(c.fset, filepath.Join(node.dir, name), parser.AllErrors|parser.ParseComments)
+		if list, ok := err.(scanner.ErrorList); ok && isUser {
+			c.diagnostics = append(c.diagnostics, errorDiagnostics(&packageError{importPath: node.importPath, err: list}, c.srcs)...)
+		} else if err != nil && file == nil {
+			return nil, err
+		}
+		if file != nil {
+			files = append(files, file) // Partial on syntax errors: still report the type errors of the rest
+		}
+	}
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if path == "unsafe" {
+				return types.Unsafe, nil
+			}
+			if actualPath, ok := node.importMap[path]; ok {
+				path = actualPath
+			}
+			for _, dep := range node.imports {
+				if dep.importPath == path {
+					return c.load(dep)
+				}
+			}
+			return c.exported.Import(path) // The precompiled standard library is not explored
+		}),
+		Sizes: types.SizesFor("gc", c.buildCtx.GOARCH),
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok && isUser {
+				pos := typeErr.Fset.Position(typeErr.Pos)
+				c.diagnostics = append(c.diagnostics, diagnostic{Package: node.importPath, File: c.srcs.originalSourcePath(pos.Filename),
+					Line: pos.Line, Column: pos.Column, Severity: "error", Message: typeErr.Msg, Source: "check"})
+			}
+		},
+	}
+	setCheckGoVersion(&conf, node.goVersion)
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Implicits:  map[ast.Node]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+		Scopes:     map[ast.Node]*types.Scope{},
+	}
+	pkg, _ := conf.Check(node.importPath, c.fset, files, info) // Errors are reported above
+	c.checked[node], c.files[node], c.info[node] = pkg, files, info
+	return pkg, nil
+}
@@ -0,0 +1,13 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import "go/types"
+
+// setCheckGoVersion makes go/types check the language version of the package, like compile -lang.
+func setCheckGoVersion(conf *types.Config, goVersion string) {
+	if goVersion != "" {
+		conf.GoVersion = "go" + langVersion(goVersion)
+	}
+}
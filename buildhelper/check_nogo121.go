@@ -0,0 +1,9 @@
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import "go/types"
+
+// setCheckGoVersion does nothing before Go 1.21: go/types checks the latest language version it supports.
+func setCheckGoVersion(conf *types.Config, goVersion string) {}
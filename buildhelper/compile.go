@@ -3,23 +3,38 @@ package main
 import (
 	"errors"
 	"go/build"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
-func compile(t *parsedTreeNode, buildDir string, precompiledInternal bool, buildCtx build.Context) (*os.File, [][]string, []string, error) {
-	importCfg, err := os.OpenFile(filepath.Join(buildDir, "importCfg"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+func compile(t *parsedTreeNode, buildDir string, precompiledInternal bool, srcs *sources, buildCtx build.Context) (*os.File, []*action, []string, error) {
+	importCfg, actions, targets, err := compilePackages([]*parsedTreeNode{t}, buildDir, precompiledInternal, srcs, buildCtx)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	commands, linkPackages, err := compileRecursive(t, true, importCfg, buildDir, buildCtx, map[*parsedTreeNode]struct{}{})
+	return importCfg, actions, targets[0].packages, nil
+}
+
+// linkTarget is a compiled root package, with what its link needs (only main packages are linked).
+type linkTarget struct {
+	node     *parsedTreeNode
+	packages []string // the compiled archive of the package (none if a previous root already imported it)
+	deps     []string // the actions that the link must wait for (see linkDeps)
+}
+
+// compilePackages generates the compile actions of several root packages (e.g. matched by a pattern), compiling each
+// of their dependencies once.
+func compilePackages(roots []*parsedTreeNode, buildDir string, precompiledInternal bool, srcs *sources, buildCtx build.Context) (*os.File, []*action, []linkTarget, error) {
+	importCfg, err := os.OpenFile(filepath.Join(buildDir, "importCfg"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	if precompiledInternal {
-		// Add all standard (precompiled) library packs to importCfg
+		// Add all standard (precompiled) library packs to importCfg first, as compileImportCfg copies it
 		pkgPath := goPkgPath(buildCtx)
 		err = filepath.Walk(pkgPath, func(path string, info os.FileInfo, err error) error {
 			if strings.HasSuffix(path, ".a") {
@@ -32,136 +47,239 @@ func compile(t *parsedTreeNode, buildDir string, precompiledInternal bool, build
 			}
 			return nil
 		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
 	}
-	if err != nil {
-		return nil, nil, nil, err
+	var actions []*action
+	var targets []linkTarget
+	alreadyCompiled := map[*parsedTreeNode]string{}
+	for _, root := range roots {
+		rootActions, linkPackages, err := compileRecursive(root, true, importCfg, buildDir, srcs, buildCtx, alreadyCompiled)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		actions = append(actions, rootActions...)
+		targets = append(targets, linkTarget{node: root, packages: linkPackages})
+	}
+	for i := range targets {
+		targets[i].deps = linkDeps(targets[i].node, alreadyCompiled)
 	}
-	return importCfg, commands, linkPackages, err
+	return importCfg, actions, targets, nil
 }
 
-// compileRecursive compiles generates all compile commands based on the parsed tree structure.
-// It ensures that all dependencies are already compiled before compiling the current package.
-func compileRecursive(node *parsedTreeNode, isRoot bool, cfg *os.File, buildDir string, buildCtx build.Context, alreadyCompiled map[*parsedTreeNode]struct{}) ([][]string, []string, error) {
+// linkDeps returns the actions that the link of a root package must wait for: the final action of each package that
+// it (transitively) imports, unless the action of an importer already waits for it. finalActions maps each compiled
+// package to its final action ID ("" if it needs no action), like in compileRecursive.
+func linkDeps(root *parsedTreeNode, finalActions map[*parsedTreeNode]string) []string {
+	var reachable []*parsedTreeNode
+	covered := map[*parsedTreeNode]bool{} // imported by a package with an action
+	seen := map[*parsedTreeNode]bool{}
+	var walk func(node *parsedTreeNode)
+	walk = func(node *parsedTreeNode) {
+		if seen[node] {
+			return
+		}
+		seen[node] = true
+		reachable = append(reachable, node)
+		for _, dep := range node.imports {
+			if finalActions[node] != "" {
+				covered[dep] = true
+			}
+			walk(dep)
+		}
+	}
+	walk(root)
+	var deps []string
+	for _, node := range reachable {
+		if actionID := finalActions[node]; actionID != "" && !covered[node] {
+			deps = append(deps, actionID)
+		}
+	}
+	return deps
+}
+
+// compileRecursive generates all compile actions based on the parsed tree structure.
+// Each package's compile action depends on the final action (compile or pack) of all of its imports, so that the
+// plan keeps the ordering guarantees of a depth-first build while leaving independent packages free to run in parallel.
+// alreadyCompiled maps each processed node to its final action ID ("" if it did not need any action).
+func compileRecursive(node *parsedTreeNode, isRoot bool, cfg *os.File, buildDir string, srcs *sources, buildCtx build.Context, alreadyCompiled map[*parsedTreeNode]string) ([]*action, []string, error) {
 	// Check if it was already compiled (more than one node depends on this package, and it was already processed) and skip
 	if _, ok := alreadyCompiled[node]; ok {
 		return nil, nil, nil
 	}
-	alreadyCompiled[node] = struct{}{}
+	alreadyCompiled[node] = ""
 
 	// Recurse into dependencies
-	var commands [][]string
+	var actions []*action
 	var linkPackages []string
+	var depActionIDs []string
 	for _, dep := range node.imports {
-		commandsDep, linkPackagesDep, err := compileRecursive(dep, false, cfg, buildDir, buildCtx, alreadyCompiled)
+		actionsDep, linkPackagesDep, err := compileRecursive(dep, false, cfg, buildDir, srcs, buildCtx, alreadyCompiled)
 		if err != nil {
 			return nil, nil, err
 		}
-		commands = append(commands, commandsDep...)
+		actions = append(actions, actionsDep...)
 		linkPackages = append(linkPackages, linkPackagesDep...)
+		if depActionID := alreadyCompiled[dep]; depActionID != "" {
+			depActionIDs = append(depActionIDs, depActionID)
+		}
 	}
 
-	// Check if the package is already cached and register it
+	if len(node.goFileNames) == 0 && node.validPrecompiledArchivePath == "" {
+		return nil, nil, errors.New("no .go files to compile in package " + node.importPath + ", check build tags and update vendored dependencies.")
+	}
+
+	// Output-independent flags for the tools (also part of the action ID)
+	compileFlags := compileToolFlags(node, srcs, buildCtx)
+	asmFlags := asmToolFlags(node, srcs, buildCtx)
+
+	// Check if the package is already cached (or precompiled) and register it
+	if node.validPrecompiledArchivePath == "" {
+		toolFlags := append(append([]string{"compile"}, compileFlags...), "asm")
+		actionID, err := compileActionID(node, append(toolFlags, asmFlags...), srcs, buildCtx)
+		if err != nil {
+			return nil, nil, err
+		}
+		node.actionID = actionID
+		node.validPrecompiledArchivePath = checkCachedArchive(node.actionID, len(node.assemblyFileNames))
+	} else {
+		node.actionID = hashString(node.validPrecompiledArchivePath)
+	}
 	cachedCompiledArchive := node.validPrecompiledArchivePath != ""
 	log.Println("Processing", node.importPath, "(", node.dir, ") internal =", node.internal, ", cached =", cachedCompiledArchive)
-	pkgObj := pkgArchiveCacheFor(node.importPath, buildDir)
-	if isRoot {
-		linkPackages = append(linkPackages, pkgObj)
-	}
+	pkgObj := pkgArchiveCacheFor(node.actionID, cacheDir())
 	if cachedCompiledArchive {
 		// Use this cache instead of generating commands
 		pkgObj = node.validPrecompiledArchivePath
 	}
-	_, err := cfg.Write([]byte("packagefile " + node.importPath + "=" + pkgObj + "\n"))
-	if err != nil {
+	if isRoot {
+		linkPackages = append(linkPackages, pkgObj)
+	}
+	if _, err := cfg.Write([]byte("packagefile " + node.importPath + "=" + pkgObj + "\n")); err != nil {
 		log.Fatal(err)
 	}
 	if cachedCompiledArchive {
-		return commands, linkPackages, nil // Nothing more to do
+		return actions, linkPackages, nil // Nothing more to do
+	}
+
+	// ### Generate all actions to compile the current package
+	firstAction := len(actions)
+	// Each package gets its own directory for the go_asm.h header, as packages may be compiled concurrently
+	asmHdrDir := filepath.Join(buildDir, "_asm_"+hashString(planName(node)))
+	asmHdrFilePath := filepath.Join(asmHdrDir, "go_asm.h")
+	asmFilesAbs := make([]string, len(node.assemblyFileNames))
+	for i, ab := range node.assemblyFileNames {
+		asmFilesAbs[i] = srcs.actualSourcePath(filepath.Join(node.dir, ab))
+	}
+	var asmHeadersAbs []string
+	if len(node.assemblyFileNames) > 0 {
+		headers, err := assemblyHeaderFiles(node.dir, srcs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, header := range headers {
+			asmHeadersAbs = append(asmHeadersAbs, filepath.Join(node.dir, header))
+		}
+		if err = os.MkdirAll(asmHdrDir, 0755); err != nil {
+			return nil, nil, err
+		}
+		// Like go build, the symbol ABIs pre-pass reads an empty go_asm.h, as it is only generated by the compiler
+		if err = ioutil.WriteFile(asmHdrFilePath, nil, 0644); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// ### Generate all commands to compile the current package
 	// === ASM (pre-pass to generate symbol ABIs) ===
-	symabisFilePath := filepath.Join(buildDir, "symabis_"+hashString(node.importPath))
+	symabisFilePath := filepath.Join(buildDir, "symabis_"+hashString(planName(node)))
+	compileDeps := depActionIDs
 	if len(node.assemblyFileNames) > 0 {
-		asmPreCommand := []string{
-			"asm",
-			"-p", node.importPath,
-			"-I", buildDir,
+		asmPreCommand := append([]string{"asm"}, asmFlags...)
+		asmPreCommand = append(asmPreCommand,
+			"-I", asmHdrDir,
 			"-I", filepath.Join(filepath.Dir(goPkgPath(buildCtx)), "include"),
-			"-D", "GOOS_" + buildCtx.GOOS,
-			"-D", "GOARCH_" + buildCtx.GOARCH,
 			"-gensymabis",
 			"-o", symabisFilePath,
-		}
-		if node.internal {
-			asmPreCommand = append(asmPreCommand, "-compiling-runtime")
-		}
-		filesAbs := make([]string, len(node.assemblyFileNames))
-		for i, ab := range node.assemblyFileNames {
-			filesAbs[i] = filepath.Join(node.dir, ab)
-		}
-		asmPreCommand = append(asmPreCommand, filesAbs...)
-		commands = append(commands, asmPreCommand)
+		)
+		asmPreCommand = append(asmPreCommand, asmFilesAbs...)
+		symabisAction := newAction("symabis "+planName(node), nil, append(append([]string{}, asmFilesAbs...), asmHeadersAbs...),
+			[]string{symabisFilePath}, asmPreCommand)
+		actions = append(actions, symabisAction)
+		compileDeps = append(compileDeps, symabisAction.ID)
 	}
 
 	// === COMPILE ===
-	compileCommand := []string{
-		"compile",
+	compileCfg, err := compileImportCfg(node, cfg, buildDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	compileCommand := append([]string{"compile"}, compileFlags...)
+	compileCommand = append(compileCommand,
 		"-o", pkgObj,
-		"-p", node.importPath,
-		//"-complete", // Not when including assembly
-		// Go also writes build ID hashes to the pack files by default (and may expect them, so give any ID)
-		"-buildid", hashString(node.importPath),
+		// Go also writes build ID hashes to the pack files by default (and may expect them, so give the action ID)
+		"-buildid", node.actionID,
 		//"-pack", // packed later (including asm)
-		"-importcfg", cfg.Name(),
-	}
-	if node.internal {
-		if strings.HasPrefix(node.importPath, "runtime") && node.importPath != "runtime/trace" {
-			compileCommand = append(compileCommand, "-std", "-+")
-		}
-	}
-	asmHdrFilePath := filepath.Join(buildDir, "go_asm.h")
+		"-importcfg", compileCfg,
+	)
+	compileOutputs := []string{pkgObj}
 	if len(node.assemblyFileNames) > 0 {
 		compileCommand = append(compileCommand, "-symabis", symabisFilePath, "-asmhdr", asmHdrFilePath)
-	} else {
-		if !node.internal { // <- This is a hack, probably will fail
-			compileCommand = append(compileCommand, "-complete")
-		}
+		compileOutputs = append(compileOutputs, asmHdrFilePath)
 	}
-	if len(node.goFileNames) == 0 {
-		return nil, nil, errors.New("no .go files to compile in package " + node.importPath + ", check build tags and update vendored dependencies.")
+	var embedInputs []string
+	if node.embedCfg != nil {
+		embedCfgFilePath := filepath.Join(buildDir, "embedcfg_"+hashString(planName(node)))
+		if err = writeEmbedCfg(node.embedCfg, embedCfgFilePath); err != nil {
+			return nil, nil, err
+		}
+		compileCommand = append(compileCommand, "-embedcfg", embedCfgFilePath)
+		embedInputs = append(embedInputs, embedCfgFilePath)
+		for _, file := range node.embedCfg.Files {
+			embedInputs = append(embedInputs, file)
+		}
+		sort.Strings(embedInputs[1:])
 	}
 	filesAbs := make([]string, len(node.goFileNames))
 	for i, ab := range node.goFileNames {
-		filesAbs[i] = filepath.Join(node.dir, ab)
+		if filesAbs[i], err = srcs.overlayCompileFile(filepath.Join(node.dir, ab), buildDir); err != nil {
+			return nil, nil, err
+		}
 	}
 	compileCommand = append(compileCommand, filesAbs...)
-	commands = append(commands, compileCommand)
+	compileInputs := append([]string{compileCfg}, filesAbs...)
+	compileInputs = append(compileInputs, embedInputs...)
+	if len(node.assemblyFileNames) > 0 {
+		compileInputs = append(compileInputs, symabisFilePath)
+	}
+	compileAction := newAction("compile "+planName(node), compileDeps, compileInputs, compileOutputs, compileCommand)
+	actions = append(actions, compileAction)
+	alreadyCompiled[node] = compileAction.ID
 
 	// === ASM ===
 	asmObjectFiles := make([]string, len(node.assemblyFileNames))
+	packDeps := []string{compileAction.ID}
 	if len(node.assemblyFileNames) > 0 {
 		for i, assemblyFileName := range node.assemblyFileNames {
-			objFilePath := hashString(node.importPath) + "_" + assemblyFileName + ".o"
-			asmCommand := []string{
-				"asm",
-				"-p", node.importPath,
-				"-I", buildDir,
-				"-I", filepath.Join(filepath.Dir(goPkgPath(buildCtx)), "include"),
-				"-D", "GOOS_" + buildCtx.GOOS,
-				"-D", "GOARCH_" + buildCtx.GOARCH,
-				"-o", objFilePath,
-			}
-			if node.internal {
-				asmCommand = append(asmCommand, "-compiling-runtime")
-			}
-			asmCommand = append(asmCommand, filepath.Join(node.dir, assemblyFileName))
-			commands = append(commands, asmCommand)
+			objFilePath := hashString(planName(node)) + "_" + assemblyFileName + ".o"
 			asmObjectFiles[i] = filepath.Join(buildDir, objFilePath)
+			asmCommand := append([]string{"asm"}, asmFlags...)
+			asmCommand = append(asmCommand,
+				"-I", asmHdrDir,
+				"-I", filepath.Join(filepath.Dir(goPkgPath(buildCtx)), "include"),
+				"-o", asmObjectFiles[i],
+			)
+			asmCommand = append(asmCommand, asmFilesAbs[i])
+			// Depends on the compile action, which generates the go_asm.h header
+			asmAction := newAction("asm "+planName(node)+" "+assemblyFileName, []string{compileAction.ID},
+				append([]string{asmFilesAbs[i], asmHdrFilePath}, asmHeadersAbs...), []string{asmObjectFiles[i]}, asmCommand)
+			actions = append(actions, asmAction)
+			packDeps = append(packDeps, asmAction.ID)
 		}
 	}
 
 	// === PACK ===
+	// The archive is packed in place, so it is also an output of this action: it is only a valid cache entry after all
+	// actions that write it finished (executors remove the outputs of unfinished actions on failure)
 	if len(node.assemblyFileNames) > 0 {
 		packCommand := []string{
 			"pack",
@@ -169,8 +287,59 @@ func compileRecursive(node *parsedTreeNode, isRoot bool, cfg *os.File, buildDir
 			pkgObj,
 		}
 		packCommand = append(packCommand, asmObjectFiles...)
-		commands = append(commands, packCommand)
+		packAction := newAction("pack "+planName(node), packDeps, append([]string{pkgObj}, asmObjectFiles...),
+			[]string{pkgObj}, packCommand)
+		actions = append(actions, packAction)
+		alreadyCompiled[node] = packAction.ID
+	}
+	for _, a := range actions[firstAction:] {
+		a.Package = node.importPath
+	}
+
+	return actions, linkPackages, nil
+}
+
+// planName returns the name of a package in the plan (action IDs and build files): its import path, unless several
+// packages share it (the main packages matched by a pattern are named by the import path of their directory).
+func planName(node *parsedTreeNode) string {
+	if node.planName != "" {
+		return node.planName
 	}
+	return node.importPath
+}
 
-	return commands, linkPackages, nil
+// compileImportCfg returns the importcfg file to compile a package with: the shared one (that already lists all of its
+// dependencies), or a copy of it with importmap lines if the package imports packages by another path (see
+// stdImportPath and gopathMode). The mappings only apply to the package that imports them.
+func compileImportCfg(node *parsedTreeNode, cfg *os.File, buildDir string) (string, error) {
+	if len(node.importMap) == 0 {
+		return cfg.Name(), nil
+	}
+	var importMap []string
+	for importPath, actualPath := range node.importMap {
+		importMap = append(importMap, "importmap "+importPath+"="+actualPath+"\n")
+	}
+	sort.Strings(importMap)
+	packageFiles, err := ioutil.ReadFile(cfg.Name())
+	if err != nil {
+		return "", err
+	}
+	cfgPath := filepath.Join(buildDir, "importcfg_"+hashString(planName(node)))
+	return cfgPath, ioutil.WriteFile(cfgPath, append([]byte(strings.Join(importMap, "")), packageFiles...), 0644)
+}
+
+// assemblyHeaderFiles returns the names of the header files of the package directory, which its assembly files may
+// include.
+func assemblyHeaderFiles(dir string, srcs *sources) ([]string, error) {
+	names, err := srcs.readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var headers []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".h") {
+			headers = append(headers, name)
+		}
+	}
+	return headers, nil
 }
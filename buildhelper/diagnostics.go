@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// diagnosticsFileName is the file of the build directory with the diagnostics of a failed build (removed by every
+// build, so it only exists after a failure).
+const diagnosticsFileName = "diagnostics.json"
+
+// diagnostic is a structured error of the build, for editors. Positions refer to the sources of the user: never to
+// the replacements or copies of overlaid files.
+type diagnostic struct {
+	Package  string `json:"package,omitempty"` // import path of the package ("" if unknown, e.g. for link errors)
+	File     string `json:"file,omitempty"`    // "" for errors without a position
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"` // 0 if unknown (e.g. asm errors)
+	Severity string `json:"severity"`         // "error" or "warning"
+	Message  string `json:"message"`
+	Source   string `json:"source"` // buildhelper (parse and resolution errors), or the tool: compile, asm, link...
+}
+
+// packageError is an error found while parsing a package, positioned at pos if it is valid (e.g. at the import
+// declaration of a package that can't be resolved).
+type packageError struct {
+	importPath string
+	pos        token.Position
+	err        error
+}
+
+func (e *packageError) Error() string {
+	if e.pos.IsValid() {
+		return e.pos.String() + ": " + e.err.Error()
+	}
+	return e.err.Error()
+}
+
+// diagnosticLinePattern matches the lines of positioned errors of the tools and of go/scanner: file:line[:column]: msg
+var diagnosticLinePattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseDiagnosticLine returns the diagnostic of a line of tool output, which may not have a position.
+func parseDiagnosticLine(line, importPath, source string, srcs *sources) diagnostic {
+	d := diagnostic{Package: importPath, Severity: "error", Message: line, Source: source}
+	if m := diagnosticLinePattern.FindStringSubmatch(line); m != nil {
+		d.File = srcs.originalSourcePath(m[1])
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		d.Message = m[4]
+	}
+	return d
+}
+
+// errorDiagnostics returns the diagnostics of an error of buildhelper itself (e.g. a syntax error or an unresolved
+// import).
+func errorDiagnostics(err error, srcs *sources) []diagnostic {
+	var importPath string
+	var pos token.Position
+	if pkgErr, ok := err.(*packageError); ok {
+		importPath, pos, err = pkgErr.importPath, pkgErr.pos, pkgErr.err
+	}
+	var diagnostics []diagnostic
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			diagnostics = append(diagnostics, diagnostic{Package: importPath, File: srcs.originalSourcePath(e.Pos.Filename),
+				Line: e.Pos.Line, Column: e.Pos.Column, Severity: "error", Message: e.Msg, Source: "buildhelper"})
+		}
+		return diagnostics
+	}
+	lines := strings.Split(err.Error(), "\n")
+	d := parseDiagnosticLine(lines[0], importPath, "buildhelper", srcs)
+	if pos.IsValid() {
+		d.File, d.Line, d.Column, d.Message = srcs.originalSourcePath(pos.Filename), pos.Line, pos.Column, lines[0]
+	}
+	d.Message = strings.Join(append([]string{d.Message}, lines[1:]...), "\n") // Details (e.g. of import cycles)
+	return append(diagnostics, d)
+}
+
+// toolDiagnostics returns the diagnostics of the output of a failed action. Lines indented with a tab continue the
+// message of the previous one (like the have/want details of the compiler).
+func toolDiagnostics(a *action, output string, srcs *sources) []diagnostic {
+	var diagnostics []diagnostic
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") && len(diagnostics) > 0 {
+			diagnostics[len(diagnostics)-1].Message += "\n" + line
+			continue
+		}
+		diagnostics = append(diagnostics, parseDiagnosticLine(line, a.Package, a.Command[0], srcs))
+	}
+	return diagnostics
+}
+
+// writeDiagnostics writes the diagnostics of a failed build to the build directory.
+func writeDiagnostics(buildDir string, diagnostics []diagnostic) {
+	if diagnostics == nil {
+		diagnostics = []diagnostic{} // Always serialize as a list
+	}
+	marshal, err := json.MarshalIndent(diagnostics, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(buildDir, diagnosticsFileName), marshal, 0644)
+	}
+	if err != nil {
+		log.Println("Error writing the diagnostics:", err)
+	}
+}
+
+// fatal reports an error of buildhelper as diagnostics, and exits.
+func fatal(buildDir string, err error, srcs *sources) {
+	writeDiagnostics(buildDir, errorDiagnostics(err, srcs))
+	log.Fatal(err)
+}
+
+// removeDiagnostics removes the diagnostics of a previous build.
+func removeDiagnostics(buildDir string) {
+	_ = os.Remove(filepath.Join(buildDir, diagnosticsFileName))
+}
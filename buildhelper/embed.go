@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"golang.org/x/mod/module"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// embedPattern is a single pattern of a //go:embed directive.
+type embedPattern struct {
+	pattern string
+	pos     token.Position
+}
+
+// embedCfg is the JSON configuration read by the compiler (-embedcfg) to resolve //go:embed directives.
+type embedCfg struct {
+	Patterns map[string][]string // pattern -> matched files (relative to the package directory)
+	Files    map[string]string   // file (relative to the package directory) -> absolute path
+}
+
+// parseEmbedPatterns returns all //go:embed patterns of the given Go file.
+// Package files are parsed with parser.ImportsOnly, so the file is parsed again with comments (only if it imports embed).
+func parseEmbedPatterns(fset *token.FileSet, filePath string, file *ast.File, srcs *sources) ([]embedPattern, error) {
+	importsEmbed := false
+	for _, imp := range file.Imports {
+		if imp.Path.Value == `"embed"` {
+			importsEmbed = true
+			break
+		}
+	}
+	if !importsEmbed {
+		return nil, nil
+	}
+	fullFile, err := srcs.parseFile(fset, filePath, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var res []embedPattern
+	for _, group := range fullFile.Comments {
+		for _, comment := range group.List {
+			if !strings.HasPrefix(comment.Text, "//go:embed") {
+				continue
+			}
+			args := strings.TrimPrefix(comment.Text, "//go:embed")
+			if args != "" && args[0] != ' ' && args[0] != '\t' {
+				continue // Another directive (e.g. //go:embedded)
+			}
+			pos := fset.Position(comment.Pos())
+			patterns, err := parseEmbedArgs(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid //go:embed directive: %v", pos, err)
+			}
+			for _, pattern := range patterns {
+				res = append(res, embedPattern{pattern: pattern, pos: pos})
+			}
+		}
+	}
+	return res, nil
+}
+
+// parseEmbedArgs splits the arguments of a //go:embed directive, which may also be Go string literals.
+func parseEmbedArgs(args string) ([]string, error) {
+	var list []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var pattern string
+		switch args[0] {
+		default:
+			i := len(args)
+			for j, c := range args {
+				if unicode.IsSpace(c) {
+					i = j
+					break
+				}
+			}
+			pattern = args[:i]
+			args = args[i:]
+		case '`':
+			i := strings.Index(args[1:], "`")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args)
+			}
+			pattern = args[1 : 1+i]
+			args = args[1+i+1:]
+		case '"':
+			i := 1
+			for ; i < len(args); i++ {
+				if args[i] == '\\' {
+					i++
+					continue
+				}
+				if args[i] == '"' {
+					break
+				}
+			}
+			if i >= len(args) {
+				return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args)
+			}
+			q, err := strconv.Unquote(args[:i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args[:i+1])
+			}
+			pattern = q
+			args = args[i+1:]
+		}
+		if args != "" {
+			r, _ := utf8.DecodeRuneInString(args)
+			if !unicode.IsSpace(r) {
+				return nil, fmt.Errorf("invalid quoted string in //go:embed: %s", args)
+			}
+		}
+		list = append(list, pattern)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("usage: //go:embed pattern...")
+	}
+	return list, nil
+}
+
+// resolveEmbedPatterns matches the patterns against the files of the package directory, following the rules of the go
+// command: patterns can't escape the package directory (or enter other modules), must match at least one file, and
+// directories are embedded recursively, skipping files starting with '.' or '_' unless the pattern uses the all: prefix.
+func resolveEmbedPatterns(pkgDir string, patterns []embedPattern, srcs *sources) (*embedCfg, error) {
+	cfg := &embedCfg{Patterns: map[string][]string{}, Files: map[string]string{}}
+	for _, p := range patterns {
+		if _, ok := cfg.Patterns[p.pattern]; ok {
+			continue // Already resolved
+		}
+		files, err := resolveEmbedPattern(pkgDir, p.pattern, srcs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: pattern %s: %v", p.pos, p.pattern, err)
+		}
+		cfg.Patterns[p.pattern] = files
+		for _, file := range files {
+			cfg.Files[file] = srcs.actualSourcePath(filepath.Join(pkgDir, filepath.FromSlash(file)))
+		}
+	}
+	return cfg, nil
+}
+
+func resolveEmbedPattern(pkgDir, pattern string, srcs *sources) ([]string, error) {
+	glob := pattern
+	all := strings.HasPrefix(pattern, "all:")
+	if all {
+		glob = pattern[len("all:"):]
+	}
+	// Check pattern is valid for //go:embed
+	if _, err := path.Match(glob, ""); err != nil || !validEmbedPattern(glob) {
+		return nil, errors.New("invalid pattern syntax")
+	}
+	// Glob to find matches
+	matches, err := srcs.glob(filepath.Join(escapeGlob(pkgDir), filepath.FromSlash(glob)))
+	if err != nil {
+		return nil, err
+	}
+	// Filter list of matches according to the go command's rules
+	var files []string
+	for _, match := range matches {
+		rel := filepath.ToSlash(match[len(pkgDir)+1:]) // Can't escape pkgDir as ".." elements are not valid
+		info, err := srcs.lstat(match)
+		if err != nil {
+			return nil, err
+		}
+		what := "file"
+		if info.IsDir() {
+			what = "directory"
+		}
+		// Check that the match is not in another module (a directory up to pkgDir with a go.mod file)
+		for dir := match; len(dir) > len(pkgDir); dir = filepath.Dir(dir) {
+			if dir == match && !info.IsDir() {
+				continue
+			}
+			if _, err = srcs.stat(filepath.Join(dir, "go.mod")); err == nil {
+				return nil, fmt.Errorf("cannot embed %s %s: in different module", what, rel)
+			}
+		}
+		switch {
+		case info.Mode().IsRegular():
+			if err = module.CheckFilePath(rel); err != nil {
+				return nil, fmt.Errorf("cannot embed file %s: invalid name %s", rel, filepath.Base(match))
+			}
+			files = append(files, rel)
+		case info.IsDir():
+			count := 0
+			err = srcs.walk(match, func(walkPath string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				walkRel := filepath.ToSlash(walkPath[len(pkgDir)+1:])
+				name := info.Name()
+				if err = module.CheckFilePath(walkRel); err != nil {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil // Ignore bad names, assuming they won't go into modules
+				}
+				if info.IsDir() {
+					if walkPath != match {
+						if _, err = srcs.stat(filepath.Join(walkPath, "go.mod")); err == nil {
+							return filepath.SkipDir // Another module
+						}
+						if !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+							return filepath.SkipDir
+						}
+					}
+					return nil
+				}
+				if !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					return nil
+				}
+				if !info.Mode().IsRegular() {
+					return nil // Ignore irregular files inside directories
+				}
+				count++
+				files = append(files, walkRel)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return nil, fmt.Errorf("cannot embed directory %s: contains no embeddable files", rel)
+			}
+		default:
+			return nil, fmt.Errorf("cannot embed irregular file %s", rel)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no matching files found")
+	}
+	sort.Strings(files)
+	uniqueFiles := files[:1]
+	for _, file := range files[1:] { // Matches may overlap
+		if file != uniqueFiles[len(uniqueFiles)-1] {
+			uniqueFiles = append(uniqueFiles, file)
+		}
+	}
+	return uniqueFiles, nil
+}
+
+// validEmbedPattern reports whether the pattern is valid for //go:embed: an unrooted slash-separated path without
+// empty, "." or ".." elements.
+func validEmbedPattern(pattern string) bool {
+	if pattern == "" || strings.HasPrefix(pattern, "/") || strings.HasSuffix(pattern, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(pattern, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeGlob escapes the glob meta-characters of a literal path.
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) && filepath.Separator != '\\' {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// writeEmbedCfg writes the embed configuration of the node for the compiler.
+func writeEmbedCfg(cfg *embedCfg, embedCfgPath string) error {
+	marshal, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(embedCfgPath, marshal, 0644)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// In GOPATH mode, imports are resolved like the legacy go command: in the vendor directories of the importer and of its
+// parents (up to the src directory of its GOPATH entry), then in the standard library, and finally in the src directory
+// of each GOPATH entry, in order. Vendored packages are compiled with their full path (e.g. a/vendor/b for the package b
+// vendored by a), so that the same package vendored twice never clashes (importers map the paths with importmap lines,
+// see compileImportCfg).
+
+// gopathMode reports whether the imports of the package at dir are resolved in GOPATH mode, following GO111MODULE: off
+// always selects it, on never does, and auto (or unset) selects it outside modules (without go.mod or go.work file).
+func gopathMode(dir string, srcs *sources) bool {
+	switch os.Getenv("GO111MODULE") {
+	case "off":
+		return true
+	case "on":
+		return false
+	}
+	if _, modulePath, _ := findAndParseGoMod(dir, srcs); modulePath != "" {
+		return false
+	}
+	ws, err := findAndParseGoWork(dir, srcs)
+	return ws == nil && err == nil
+}
+
+// gopathSrcDirs returns the src directory of each entry of goPath (a list, like $GOPATH).
+func gopathSrcDirs(goPath string) []string {
+	var dirs []string
+	for _, entry := range filepath.SplitList(goPath) {
+		if entry != "" {
+			dirs = append(dirs, filepath.Join(entry, "src"))
+		}
+	}
+	return dirs
+}
+
+// gopathSrcDirFor returns the src directory of the GOPATH entry that contains dir, or "" if none does.
+func gopathSrcDirFor(dir string, ctx build.Context) string {
+	for _, srcDir := range gopathSrcDirs(ctx.GOPATH) {
+		if strings.HasPrefix(dir, srcDir+string(filepath.Separator)) {
+			return srcDir
+		}
+	}
+	return ""
+}
+
+// gopathImportPath returns the import path of the package at dir in GOPATH mode: its path relative to the src directory
+// of its GOPATH entry, or "" if it is outside of GOPATH.
+func gopathImportPath(dir string, ctx build.Context) string {
+	srcDir := gopathSrcDirFor(dir, ctx)
+	if srcDir == "" {
+		return ""
+	}
+	return filepath.ToSlash(dir[len(srcDir)+1:])
+}
+
+// parseFindGopathDirForImport resolves an import of the package at importerDir in GOPATH mode (see gopathMode). The
+// vendor directories are searched up to the src directory of the GOPATH entry of the importer (excluded, like the go
+// command), or up to the main package directory (included) for packages outside of GOPATH.
+func parseFindGopathDirForImport(importPath, importerDir, buildDir string, srcs *sources, ctx build.Context) (dir string, isInternal bool, precompiledArchive string) {
+	root, rootIncluded := gopathSrcDirFor(importerDir, ctx), false
+	if root == "" {
+		root, rootIncluded = buildDir, true
+	}
+	for d := importerDir; d == root || strings.HasPrefix(d, root+string(filepath.Separator)); d = filepath.Dir(d) {
+		if d == root && !rootIncluded {
+			break
+		}
+		vendorPath := filepath.Join(d, "vendor", filepath.FromSlash(importPath))
+		if stat, err := srcs.stat(vendorPath); err == nil && stat.IsDir() {
+			return vendorPath, false, ""
+		}
+		if d == root {
+			break
+		}
+	}
+	// The standard library comes first, but the packages it vendors are not visible
+	stdDir, stdArchive := parseFindStdDirForImport(importPath, srcs, ctx)
+	if stdDir != "" && stdImportPath(importPath, stdDir, ctx) == importPath {
+		return stdDir, true, stdArchive
+	}
+	for _, srcDir := range gopathSrcDirs(ctx.GOPATH) {
+		gopathPath := filepath.Join(srcDir, filepath.FromSlash(importPath))
+		if stat, err := srcs.stat(gopathPath); err == nil && stat.IsDir() {
+			return gopathPath, false, ""
+		}
+	}
+	return stdDir, stdDir != "", stdArchive // Rejected by checkImportVisibility if vendored by the standard library
+}
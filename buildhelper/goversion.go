@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultGoModVersion is the language version of modules whose go.mod file has no go directive.
+const defaultGoModVersion = "1.16"
+
+// packageGoVersion returns the Go language version of the module of the package at pkgDir: the go directive of its
+// go.mod file (or of vendor/modules.txt for vendored packages). It returns "" for packages outside modules and for the
+// standard library.
+func packageGoVersion(pkgDir, buildDir string, isInternal bool, srcs *sources) string {
+	if isInternal {
+		return ""
+	}
+	if vm := vendorModulesForDir(buildDir, srcs); vm != nil && strings.HasPrefix(pkgDir, vm.dir+string(filepath.Separator)) {
+		importPath := filepath.ToSlash(pkgDir[len(vm.dir)+1:])
+		if m, ok := vm.packages[importPath]; ok && m.goVersion != "" {
+			return m.goVersion
+		}
+		return defaultGoModVersion
+	}
+	goModDir, modulePath, _ := findAndParseGoMod(pkgDir, srcs)
+	if modulePath == "" {
+		return ""
+	}
+	goMod, err := parseGoModFile(filepath.Join(goModDir, "go.mod"), srcs)
+	if err != nil || goMod.Go == nil {
+		return defaultGoModVersion
+	}
+	return goMod.Go.Version
+}
+
+// langFlag returns the compile -lang flag for the given language version of a package ("" if it must not be given):
+// before Go 1.21 only packages of modules with a supported go directive get one, and then every package does.
+func langFlag(goVersion string, srcs *sources, buildCtx build.Context) string {
+	minor := srcs.toolchainMinorVersion(buildCtx)
+	if goVersion == "" {
+		if minor < 21 {
+			return ""
+		}
+		goVersion = fmt.Sprintf("1.%d", minor) // The version of the toolchain (like the standard library)
+	}
+	lang := langVersion(goVersion)
+	if semver.Compare("v"+lang, fmt.Sprintf("v1.%d", minor)) > 0 {
+		log.Println("Go language version", goVersion, "is newer than the toolchain at GOROOT, ignoring it")
+		return ""
+	}
+	return "-lang=go" + lang
+}
+
+// langVersion returns the language version (major.minor) of a Go version (e.g. 1.21 for 1.21.3 or 1.21rc1).
+func langVersion(goVersion string) string {
+	parts := strings.SplitN(goVersion, ".", 3)
+	if len(parts) < 2 {
+		return goVersion
+	}
+	minor := parts[1]
+	for i, c := range minor {
+		if c < '0' || c > '9' {
+			minor = minor[:i]
+			break
+		}
+	}
+	return parts[0] + "." + minor
+}
+
+// parseGoDebugDirectives returns the settings (key=value) of the //go:debug directives of the given Go file, which must
+// be placed before the package clause.
+func parseGoDebugDirectives(fset *token.FileSet, filePath string, srcs *sources) ([]string, error) {
+	header, err := srcs.parseFile(fset, filePath, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var settings []string
+	for _, group := range header.Comments {
+		if group.Pos() > header.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if !strings.HasPrefix(comment.Text, "//go:debug ") {
+				continue
+			}
+			setting := strings.TrimSpace(strings.TrimPrefix(comment.Text, "//go:debug "))
+			if i := strings.Index(setting, "="); i <= 0 || strings.ContainsAny(setting, " \t,") {
+				return nil, fmt.Errorf("%s: invalid //go:debug: %s", fset.Position(comment.Pos()), setting)
+			}
+			settings = append(settings, setting)
+		}
+	}
+	return settings, nil
+}
+
+// defaultGoDebug returns the default GODEBUG of a main package, like the go command since Go 1.21: the defaults of the
+// language version of the main module (see internal/godebugs of GOROOT), overridden by the godebug lines of its
+// go.mod file and the //go:debug directives of the package, in this order. It returns "" if there is nothing to set.
+func defaultGoDebug(root *parsedTreeNode, srcs *sources, buildCtx build.Context) string {
+	if srcs.toolchainMinorVersion(buildCtx) < 21 {
+		return ""
+	}
+	goVersion := fmt.Sprintf("1.%d", srcs.toolchainMinorVersion(buildCtx)) // Outside modules
+	settings := map[string]string{}
+	mainDir := root.dir
+	if root.generated && len(root.imports) > 0 {
+		mainDir = root.imports[len(root.imports)-1].dir // The test main is generated for the last imported package
+	}
+	if ws, _ := findAndParseGoWork(mainDir, srcs); ws != nil { // Errors are reported before parsing
+		goVersion = ws.goVersion
+	} else if goModDir, modulePath, _ := findAndParseGoMod(mainDir, srcs); modulePath != "" {
+		goVersion = defaultGoModVersion
+		if goMod, err := parseGoModFile(filepath.Join(goModDir, "go.mod"), srcs); err == nil {
+			if goMod.Go != nil {
+				goVersion = goMod.Go.Version
+			}
+			for _, setting := range goModGoDebugs(goMod) {
+				settings[setting[:strings.Index(setting, "=")]] = setting[strings.Index(setting, "=")+1:]
+			}
+		}
+	}
+	for _, setting := range root.goDebug {
+		key, value := setting[:strings.Index(setting, "=")], setting[strings.Index(setting, "=")+1:]
+		if key == "default" {
+			goVersion = strings.TrimPrefix(value, "go")
+		} else {
+			settings[key] = value
+		}
+	}
+	delete(settings, "default")
+	defaults, err := goDebugDefaults(langVersion(goVersion), buildCtx)
+	if err != nil {
+		log.Println("Error reading the GODEBUG defaults of the toolchain:", err)
+	}
+	for key, value := range settings {
+		defaults[key] = value
+	}
+	var keys []string
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var res []string
+	for _, key := range keys {
+		res = append(res, key+"="+defaults[key])
+	}
+	return strings.Join(res, ",")
+}
+
+// goModGoDebugs returns the settings of the godebug lines of a go.mod file (Go 1.23+), that x/mod does not parse yet.
+func goModGoDebugs(goMod *modfile.File) []string {
+	var settings []string
+	addLine := func(tokens []string) {
+		setting := strings.Join(tokens, "")
+		if strings.Contains(setting, "=") {
+			settings = append(settings, setting)
+		}
+	}
+	for _, stmt := range goMod.Syntax.Stmt {
+		switch x := stmt.(type) {
+		case *modfile.Line:
+			if len(x.Token) > 1 && x.Token[0] == "godebug" {
+				addLine(x.Token[1:])
+			}
+		case *modfile.LineBlock:
+			if x.Token[0] == "godebug" {
+				for _, line := range x.Line {
+					addLine(line.Token)
+				}
+			}
+		}
+	}
+	return settings
+}
+
+// goDebugDefaults returns the GODEBUG settings whose defaults changed after the given language version, with their old
+// values, from the internal/godebugs table of the standard library sources.
+func goDebugDefaults(lang string, buildCtx build.Context) (map[string]string, error) {
+	defaults := map[string]string{}
+	if !strings.HasPrefix(lang, "1.") {
+		return defaults, nil
+	}
+	minor, err := strconv.Atoi(lang[len("1."):])
+	if err != nil {
+		return defaults, nil
+	}
+	tablePath := filepath.Join(goSrcPath(buildCtx), "internal", "godebugs", "table.go")
+	table, err := parser.ParseFile(token.NewFileSet(), tablePath, nil, 0)
+	if err != nil {
+		return defaults, err
+	}
+	ast.Inspect(table, func(n ast.Node) bool {
+		info, ok := n.(*ast.CompositeLit)
+		if !ok || info.Type != nil { // The entries of the table omit their type
+			return true
+		}
+		var name, old string
+		var changed int
+		for _, elt := range info.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				return true
+			}
+			key, _ := kv.Key.(*ast.Ident)
+			lit, _ := kv.Value.(*ast.BasicLit)
+			if key == nil || lit == nil {
+				continue
+			}
+			switch key.Name {
+			case "Name":
+				name, _ = strconv.Unquote(lit.Value)
+			case "Old":
+				old, _ = strconv.Unquote(lit.Value)
+			case "Changed":
+				changed, _ = strconv.Atoi(lit.Value)
+			}
+		}
+		if name != "" && minor < changed {
+			defaults[name] = old
+		}
+		return false
+	})
+	return defaults, nil
+}
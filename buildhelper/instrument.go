@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// instrumentationFileName is the name of the file generated in the main package for the instrumentation hooks.
+const instrumentationFileName = "zz_buildhelper_instrument.go"
+
+// instrumentedMainName is the name that the main function of the user gets when a hook wraps it.
+const instrumentedMainName = "buildhelperUserMain"
+
+// stopFnEnvVar is the environment variable with the name of the global JS function that the stop hook sets up.
+const stopFnEnvVar = "JS_GLOBAL_STOP_FN"
+
+// instrumentationHook is code added to main packages at build time (see -instrument).
+type instrumentationHook struct {
+	name     string
+	goos     string   // the only target GOOS that supports the hook ("" for all)
+	imports  []string // import specs of the code (with buildhelper names, to never conflict with the user's)
+	decls    string   // top-level declarations
+	deferred string   // function deferred by the main function, which the hook wraps ("" to leave it alone)
+	atExit   string   // function called before the program exits through buildhelperExit ("" for none)
+}
+
+// instrumentationHooks are the available hooks, in the order they are applied: the functions deferred by the wrapped
+// main function run in reverse order.
+var instrumentationHooks = []instrumentationHook{{
+	name:    "flush",
+	imports: nil,
+	decls: `// buildhelperFlush flushes the output of the program (e.g. the last incomplete line buffered by a JS host).
+func buildhelperFlush() {
+	buildhelperOs.Stdout.Sync()
+	buildhelperOs.Stderr.Sync()
+}
+`,
+	deferred: "buildhelperFlush",
+	atExit:   "buildhelperFlush",
+}, {
+	name:    "panicjson",
+	imports: []string{`buildhelperJSON "encoding/json"`, `buildhelperFmt "fmt"`, `buildhelperDebug "runtime/debug"`},
+	decls: `// buildhelperReportPanic reports a panic of the main function as a JSON line on stderr, and exits like a panic.
+func buildhelperReportPanic() {
+	if r := recover(); r != nil {
+		report, _ := buildhelperJSON.Marshal(map[string]string{
+			"panic": buildhelperFmt.Sprint(r),
+			"stack": string(buildhelperDebug.Stack()),
+		})
+		buildhelperOs.Stderr.Write(append(report, '\n'))
+		buildhelperExit(2)
+	}
+}
+`,
+	deferred: "buildhelperReportPanic",
+}, {
+	name:    "stop",
+	goos:    "js",
+	imports: []string{`buildhelperJS "syscall/js"`},
+	decls: `// The host stops the program by calling the global JS function named by $` + stopFnEnvVar + `.
+func init() {
+	if name := buildhelperOs.Getenv("` + stopFnEnvVar + `"); name != "" {
+		buildhelperJS.Global().Set(name, buildhelperJS.FuncOf(func(buildhelperJS.Value, []buildhelperJS.Value) interface{} {
+			buildhelperExit(195) // Forced exit: a custom exit code
+			return nil
+		}))
+	}
+}
+`,
+}}
+
+// instrumentMain adds the named hooks (see instrumentationHooks) to the main package at input, as a generated file in
+// its directory. The hooks that wrap the main function rename it in an overlaid copy of its file, with //line
+// directives that keep all positions: the lines of the user are never moved and their imports are left alone.
+// All files are overlaid, so the sources are never modified.
+func instrumentMain(input, buildDir string, hookNames []string, srcs *sources, buildCtx build.Context) error {
+	buildCtx = srcs.buildContext(buildCtx)
+	var hooks []instrumentationHook
+	wrapsMain := false
+	for _, hook := range instrumentationHooks {
+		if indexOf(hookNames, hook.name) < 0 {
+			continue
+		}
+		if hook.goos != "" && hook.goos != buildCtx.GOOS {
+			return fmt.Errorf("the %s instrumentation hook requires GOOS=%s", hook.name, hook.goos)
+		}
+		hooks = append(hooks, hook)
+		wrapsMain = wrapsMain || hook.deferred != ""
+	}
+	for _, name := range hookNames {
+		if !hasInstrumentationHook(name) {
+			return fmt.Errorf("unknown instrumentation hook %q", name)
+		}
+	}
+	input, err := filepath.Abs(input)
+	if err != nil {
+		return err
+	}
+	generated := generateInstrumentation(hooks, hookNames)
+	fset := token.NewFileSet()
+	generatedFile, err := parser.ParseFile(fset, instrumentationFileName, generated, 0)
+	if err != nil {
+		return fmt.Errorf("generating the instrumentation: %v", err)
+	}
+	mainFile, mainDecl, userNames, err := findMainFunc(fset, input, srcs, buildCtx)
+	if err != nil {
+		return err
+	}
+	// The generated names must not conflict with the package-level names of the user
+	generatedNames := topLevelNames(generatedFile)
+	for _, name := range append(generatedNames, instrumentedMainName) {
+		if name != "main" && name != "init" && userNames[name] {
+			return fmt.Errorf("cannot instrument the main package: it declares %s, reserved by buildhelper", name)
+		}
+	}
+	pkgDir := input
+	if stat, err := srcs.stat(input); err == nil && !stat.IsDir() {
+		pkgDir = filepath.Dir(input)
+	}
+	if _, err = srcs.stat(filepath.Join(pkgDir, instrumentationFileName)); err == nil {
+		return fmt.Errorf("cannot instrument the main package: %s already exists", instrumentationFileName)
+	}
+	instrumentDir := filepath.Join(buildDir, "_instrument")
+	if err = os.MkdirAll(instrumentDir, 0755); err != nil {
+		return err
+	}
+	if wrapsMain { // The generated main function calls the renamed one of the user
+		if mainDecl == nil {
+			return fmt.Errorf("cannot instrument the main package: %s has no func main", input)
+		}
+		contents, err := srcs.readFile(mainFile)
+		if err != nil {
+			return err
+		}
+		// A /*line*/ directive after the new name restores the columns of the rest of the line
+		pos := fset.Position(mainDecl.Name.End())
+		rename := fmt.Sprintf("%s/*line %s:%d:%d*/", instrumentedMainName, mainFile, pos.Line, pos.Column)
+		renamed := append(append(append([]byte{}, contents[:pos.Offset-len("main")]...), rename...),
+			contents[pos.Offset:]...)
+		renamedPath := filepath.Join(instrumentDir, filepath.Base(mainFile))
+		if err = ioutil.WriteFile(renamedPath, renamed, 0644); err != nil {
+			return err
+		}
+		srcs.addOverlay(mainFile, renamedPath)
+	}
+	generatedPath := filepath.Join(instrumentDir, instrumentationFileName)
+	if err = ioutil.WriteFile(generatedPath, generated, 0644); err != nil {
+		return err
+	}
+	srcs.instrumentationFile = filepath.Join(pkgDir, instrumentationFileName)
+	srcs.addOverlay(srcs.instrumentationFile, generatedPath)
+	return nil
+}
+
+// hasInstrumentationHook reports whether there is a hook with the given name.
+func hasInstrumentationHook(name string) bool {
+	for _, hook := range instrumentationHooks {
+		if hook.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// generateInstrumentation returns the Go file of the main package with the given hooks.
+func generateInstrumentation(hooks []instrumentationHook, hookNames []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by buildhelper -instrument=%s. DO NOT EDIT.\n\npackage main\n\n",
+		strings.Join(hookNames, ","))
+	imports := []string{`buildhelperOs "os"`}
+	var deferred, atExit []string
+	for _, hook := range hooks {
+		imports = append(imports, hook.imports...)
+		if hook.deferred != "" {
+			deferred = append(deferred, hook.deferred)
+		}
+		if hook.atExit != "" {
+			atExit = append(atExit, hook.atExit)
+		}
+	}
+	sort.Slice(imports, func(i, j int) bool { // By path, like gofmt
+		return imports[i][strings.Index(imports[i], " "):] < imports[j][strings.Index(imports[j], " "):]
+	})
+	fmt.Fprintf(&b, "import (\n\t%s\n)\n\n", strings.Join(imports, "\n\t"))
+	fmt.Fprintf(&b, "// buildhelperExit exits the program after running the exit hooks.\nfunc buildhelperExit(code int) {\n")
+	for _, f := range atExit {
+		fmt.Fprintf(&b, "\t%s()\n", f)
+	}
+	fmt.Fprintf(&b, "\tbuildhelperOs.Exit(code)\n}\n")
+	if len(deferred) > 0 {
+		fmt.Fprintf(&b, "\n// main runs the main function of the user, renamed to %s.\nfunc main() {\n",
+			instrumentedMainName)
+		for _, f := range deferred {
+			fmt.Fprintf(&b, "\tdefer %s()\n", f)
+		}
+		fmt.Fprintf(&b, "\t%s()\n}\n", instrumentedMainName)
+	}
+	for _, hook := range hooks {
+		fmt.Fprintf(&b, "\n%s", hook.decls)
+	}
+	return b.Bytes()
+}
+
+// findMainFunc returns the declaration of the main function of the main package at input (a directory or its files) and
+// its file, or a nil declaration if there is none, and all the package-level names of the package.
+func findMainFunc(fset *token.FileSet, input string, srcs *sources, buildCtx build.Context) (string, *ast.FuncDecl, map[string]bool, error) {
+	stat, err := srcs.stat(input)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	filePaths := append([]string{input}, srcs.moreInputFiles...)
+	if stat.IsDir() {
+		entries, err := srcs.readDir(input)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		filePaths = nil
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			if ok, err := buildCtx.MatchFile(input, name); ok && err == nil {
+				filePaths = append(filePaths, filepath.Join(input, name))
+			}
+		}
+	}
+	var mainFile string
+	var mainDecl *ast.FuncDecl
+	names := map[string]bool{}
+	for _, filePath := range filePaths {
+		file, err := srcs.parseFile(fset, filePath, 0)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if file.Name.Name != "main" {
+			continue
+		}
+		for _, name := range topLevelNames(file) {
+			names[name] = true
+		}
+		for _, decl := range file.Decls {
+			if f, ok := decl.(*ast.FuncDecl); ok && f.Recv == nil && f.Name.Name == "main" {
+				mainFile, mainDecl = filePath, f
+			}
+		}
+	}
+	return mainFile, mainDecl, names, nil
+}
+
+// topLevelNames returns the names declared at the top level of a file, including its imports.
+func topLevelNames(file *ast.File) []string {
+	var names []string
+	for _, imp := range file.Imports {
+		if imp.Name != nil {
+			names = append(names, imp.Name.Name)
+		}
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				names = append(names, d.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						names = append(names, name.Name)
+					}
+				case *ast.TypeSpec:
+					names = append(names, s.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
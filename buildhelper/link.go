@@ -1,20 +1,75 @@
 package main
 
 import (
+	"fmt"
+	"go/build"
 	"os"
+	"path"
 	"path/filepath"
+
+	"golang.org/x/mod/module"
 )
 
-func link(importCfg *os.File, linkPackages []string, commands [][]string, buildDir string) [][]string {
-	// Final link command
-	outFile := filepath.Join(buildDir, "a.out")
+func link(importCfg *os.File, linkPackages []string, actions []*action, buildDir, goDebug string) []*action {
+	// The link action must wait for every package to be built: depend on all actions that nothing else depends on
+	// (any other action is a transitive dependency of one of these)
+	dependedOn := map[string]struct{}{}
+	for _, a := range actions {
+		for _, dep := range a.Deps {
+			dependedOn[dep] = struct{}{}
+		}
+	}
+	var sinks []string
+	for _, a := range actions {
+		if _, ok := dependedOn[a.ID]; !ok {
+			sinks = append(sinks, a.ID)
+		}
+	}
+	return append(actions, linkAction("link", importCfg, linkPackages, sinks, filepath.Join(buildDir, "a.out"), goDebug))
+}
+
+// linkMains adds a link action for each main package of the targets (e.g. matched by a pattern), that writes its
+// executable to the build directory, named like go build does (see executableName).
+func linkMains(importCfg *os.File, targets []linkTarget, actions []*action, buildDir string, srcs *sources, buildCtx build.Context) ([]*action, error) {
+	dirs := map[string]string{} // by executable name
+	for _, target := range targets {
+		if target.node.importPath != "main" {
+			continue
+		}
+		name := executableName(target.node.dir, srcs, buildCtx)
+		if otherDir, ok := dirs[name]; ok {
+			return nil, fmt.Errorf("main packages %s and %s would both be linked to %s", otherDir, target.node.dir, name)
+		}
+		dirs[name] = target.node.dir
+		actions = append(actions, linkAction("link "+name, importCfg, target.packages, target.deps,
+			filepath.Join(buildDir, name), defaultGoDebug(target.node, srcs, buildCtx)))
+	}
+	return actions, nil
+}
+
+// linkAction returns the action that links the given compiled main package (with all the packages of the importcfg).
+func linkAction(id string, importCfg *os.File, linkPackages, deps []string, outFile, goDebug string) *action {
 	linkCommand := []string{
 		"link",
 		"-o", outFile,
 		"-buildmode=exe",
 		"-importcfg", importCfg.Name(),
 	}
+	if goDebug != "" {
+		linkCommand = append(linkCommand, "-X=runtime.godebugDefault="+goDebug)
+	}
 	linkCommand = append(linkCommand, linkPackages...)
-	commands = append(commands, linkCommand)
-	return commands
+	linkInputs := append([]string{importCfg.Name()}, linkPackages...)
+	return newAction(id, deps, linkInputs, []string{outFile}, linkCommand)
+}
+
+// executableName returns the name of the executable of the main package at dir: the last element of its import path,
+// or the one before it if it is a major version suffix (like go build).
+func executableName(dir string, srcs *sources, buildCtx build.Context) string {
+	importPath := importPathForDir(dir, srcs, buildCtx)
+	name := path.Base(importPath)
+	if prefix, pathMajor, ok := module.SplitPathVersion(importPath); ok && pathMajor != "" && prefix != "" {
+		name = path.Base(prefix)
+	}
+	return name
 }
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The -lsp mode serves a subset of the Language Server Protocol over stdin/stdout (JSON-RPC messages with
+// Content-Length headers): completion, hover, go-to-definition and find-references. Packages are resolved like builds,
+// and type-checked like -check (see packageChecker). The open documents are overlaid, so unsaved changes are analyzed.
+
+// lspMessage is a JSON-RPC request, notification (without ID) or response.
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method,omitempty"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+// lspResponseError is the error of a JSON-RPC response.
+type lspResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes
+const (
+	lspMethodNotFound = -32601
+	lspInternalError  = -32603
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`      // 0-based
+	Character int `json:"character"` // 0-based, in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// lspDocument is a document opened by the editor.
+type lspDocument struct {
+	text    string
+	overlay string // the file with its text, overlaid on the document path
+}
+
+// lspAnalysis is the type-checked package of a directory.
+type lspAnalysis struct {
+	checker *packageChecker
+	node    *parsedTreeNode
+}
+
+// lspServer is the state of the language server.
+type lspServer struct {
+	buildDir  string
+	srcs      *sources // the open documents are overlaid
+	buildCtx  build.Context
+	out       io.Writer
+	documents map[string]*lspDocument // by path
+	analyses  map[string]*lspAnalysis // by package directory (and test files), until a document changes
+	shutdown  bool
+}
+
+// serveLSP serves the language server protocol until the exit notification (or the end of in). The build directory
+// holds the text of the open documents, and the configuration of each analysis while it runs.
+func serveLSP(buildDir string, buildCtx build.Context, in io.Reader, out io.Writer) error {
+	buildDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(buildDir, 0755); err != nil {
+		return err
+	}
+	srcs := newSources()
+	s := &lspServer{
+		buildDir:  buildDir,
+		srcs:      srcs,
+		buildCtx:  srcs.buildContext(buildCtx),
+		out:       out,
+		documents: map[string]*lspDocument{},
+		analyses:  map[string]*lspAnalysis{},
+	}
+	reader := bufio.NewReader(in)
+	for {
+		msg, err := readLSPMessage(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit without shutdown")
+			}
+			return nil
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			if err != nil {
+				log.Println("Error handling", msg.Method+":", err)
+			}
+			continue // Notification
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID}
+		if respErr, ok := err.(*lspResponseError); ok {
+			response["error"] = respErr
+		} else if err != nil {
+			response["error"] = &lspResponseError{Code: lspInternalError, Message: err.Error()}
+		} else {
+			response["result"] = result
+		}
+		if err = writeLSPMessage(out, response); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *lspResponseError) Error() string { return e.Message }
+
+// readLSPMessage reads the next message (its headers, and its JSON content).
+func readLSPMessage(r *bufio.Reader) (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):])); err != nil {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(content, &msg); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return &msg, nil
+}
+
+// writeLSPMessage writes a message with its headers.
+func writeLSPMessage(w io.Writer, msg interface{}) error {
+	content, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	return err
+}
+
+// handle runs a request (or notification), returning its result.
+func (s *lspServer) handle(msg *lspMessage) (interface{}, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // Full contents on every change
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"."}},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"referencesProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "buildhelper"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose", "textDocument/didSave":
+		return nil, s.syncDocument(msg.Method, msg.Params)
+	case "textDocument/completion":
+		var params lspTextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params)
+	case "textDocument/hover":
+		var params lspTextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params)
+	case "textDocument/definition":
+		var params lspTextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params)
+	case "textDocument/references":
+		var params struct {
+			lspTextDocumentPositionParams
+			Context struct {
+				IncludeDeclaration bool `json:"includeDeclaration"`
+			} `json:"context"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.references(params.lspTextDocumentPositionParams, params.Context.IncludeDeclaration)
+	}
+	return nil, &lspResponseError{Code: lspMethodNotFound, Message: "unsupported method " + msg.Method}
+}
+
+// syncDocument applies the notifications of the editor about its documents.
+func (s *lspServer) syncDocument(method string, rawParams json.RawMessage) error {
+	var params struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+	}
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return err
+	}
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return err
+	}
+	s.analyses = map[string]*lspAnalysis{} // Any change may affect any package (the overlay resets the memos)
+	switch method {
+	case "textDocument/didOpen":
+		return s.setDocumentText(path, params.TextDocument.Text)
+	case "textDocument/didChange":
+		if len(params.ContentChanges) == 0 {
+			return nil
+		}
+		return s.setDocumentText(path, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		if doc, ok := s.documents[path]; ok {
+			s.srcs.removeOverlay(path)
+			_ = os.Remove(doc.overlay)
+			delete(s.documents, path)
+		}
+	}
+	return nil
+}
+
+// setDocumentText overlays the text of an open document on its path.
+func (s *lspServer) setDocumentText(path, text string) error {
+	overlay := filepath.Join(s.buildDir, "_lsp", hashString(path), filepath.Base(path))
+	if err := os.MkdirAll(filepath.Dir(overlay), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(overlay, []byte(text), 0644); err != nil {
+		return err
+	}
+	s.documents[path] = &lspDocument{text: text, overlay: overlay}
+	s.srcs.addOverlay(path, overlay)
+	return nil
+}
+
+// analyze returns the type-checked package of the Go file at path, with the other packages of the user that it
+// imports (the rest of the dependencies are read from their compiled archives when possible).
+func (s *lspServer) analyze(path string) (*lspAnalysis, error) {
+	dir := filepath.Dir(path)
+	fset := token.NewFileSet()
+	header, err := s.srcs.parseFile(fset, path, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, err
+	}
+	importPath, tests := importPathForDir(dir, s.srcs, s.buildCtx), noTestFiles
+	if strings.HasSuffix(path, "_test.go") {
+		tests = internalTestFiles
+		if strings.HasSuffix(header.Name.Name, "_test") {
+			importPath, tests = importPath+"_test", externalTestFiles
+		}
+	}
+	if header.Name.Name == "main" {
+		importPath = "main"
+	}
+	key := dir + "|" + strconv.Itoa(int(tests))
+	if analysis, ok := s.analyses[key]; ok {
+		return analysis, nil
+	}
+	if _, err = findAndParseGoWork(dir, s.srcs); err != nil {
+		return nil, err
+	}
+	if err = checkVendorConsistency(dir, s.srcs); err != nil {
+		return nil, err
+	}
+	precompiledInternal := hasPrecompiledStd(s.buildCtx)
+	node, err := parseRecursive(fset, dir, importPath, dir, s.srcs, s.buildCtx, false, precompiledInternal, tests,
+		map[string]*parsedTreeNode{})
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(cacheDir(), 0755); err != nil {
+		return nil, err
+	}
+	scratchDir, err := ioutil.TempDir(s.buildDir, "_analysis") // Requests do not share their importcfg and plan
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratchDir)
+	importCfg, _, _, err := compile(node, scratchDir, precompiledInternal, s.srcs, s.buildCtx)
+	if err != nil {
+		return nil, err
+	}
+	_ = importCfg.Close()
+	checker, err := newPackageChecker(importCfg.Name(), s.srcs, s.buildCtx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = checker.check(node); err != nil {
+		return nil, err
+	}
+	analysis := &lspAnalysis{checker: checker, node: node}
+	s.analyses[key] = analysis
+	return analysis, nil
+}
+
+// locate returns the analysis, the syntax and the position of a document position.
+func (s *lspServer) locate(params lspTextDocumentPositionParams) (*lspAnalysis, *ast.File, token.Pos, error) {
+	path, err := uriToPath(params.TextDocument.URI)
+	if err != nil {
+		return nil, nil, token.NoPos, err
+	}
+	analysis, err := s.analyze(path)
+	if err != nil {
+		return nil, nil, token.NoPos, err
+	}
+	for _, file := range analysis.checker.files[analysis.node] {
+		tokenFile := analysis.checker.fset.File(file.Pos())
+		if tokenFile == nil || tokenFile.Name() != path {
+			continue
+		}
+		text, err := s.sourceText(path)
+		if err != nil {
+			return nil, nil, token.NoPos, err
+		}
+		offset := byteOffset(text, params.Position)
+		if offset > tokenFile.Size() {
+			offset = tokenFile.Size()
+		}
+		return analysis, file, tokenFile.Pos(offset), nil
+	}
+	return nil, nil, token.NoPos, fmt.Errorf("%s is not part of the build (check its build constraints)", path)
+}
+
+// sourceText returns the text of a document, or of any source file.
+func (s *lspServer) sourceText(path string) (string, error) {
+	if doc, ok := s.documents[path]; ok {
+		return doc.text, nil
+	}
+	contents, err := s.srcs.readFile(path)
+	return string(contents), err
+}
+
+// sourcePath returns the path of a file named by the position information of a package (e.g. the export data of the
+// standard library refers to $GOROOT).
+func (s *lspServer) sourcePath(filename string) string {
+	if strings.HasPrefix(filename, "$GOROOT"+string(filepath.Separator)) || strings.HasPrefix(filename, "$GOROOT/") {
+		return filepath.Join(s.buildCtx.GOROOT, filename[len("$GOROOT/"):])
+	}
+	return filename
+}
+
+// location returns the location of an identifier (of the given length) at a position.
+func (s *lspServer) location(pos token.Position, length int) (lspLocation, bool) {
+	if !pos.IsValid() {
+		return lspLocation{}, false
+	}
+	path := s.sourcePath(pos.Filename)
+	text, err := s.sourceText(path)
+	if err != nil {
+		return lspLocation{}, false
+	}
+	start := lspPositionOf(text, pos.Line, pos.Column)
+	end := lspPositionOf(text, pos.Line, pos.Column+length)
+	return lspLocation{URI: pathToURI(path), Range: lspRange{Start: start, End: end}}, true
+}
+
+// uriToPath returns the path of a file:// URI.
+func uriToPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported URI %s: only file:// URIs are supported", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// pathToURI returns the file:// URI of a path.
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// lineText returns the given line (1-based) of a text, without its line break ("" if it does not exist).
+func lineText(text string, line int) string {
+	lines := strings.SplitN(text, "\n", line+1)
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[line-1], "\r")
+}
+
+// byteOffset returns the byte offset of an LSP position (whose character counts UTF-16 code units) in a text.
+func byteOffset(text string, pos lspPosition) int {
+	offset := 0
+	for i := 0; i < pos.Line; i++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+	units := 0
+	for i, r := range text[offset:] {
+		if units >= pos.Character || r == '\n' {
+			return offset + i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(text)
+}
+
+// lspPositionOf returns the LSP position of a line and (byte) column, both 1-based, of a text.
+func lspPositionOf(text string, line, column int) lspPosition {
+	lineStr := lineText(text, line)
+	if column-1 > len(lineStr) {
+		column = len(lineStr) + 1
+	}
+	return lspPosition{Line: line - 1, Character: len(utf16.Encode([]rune(lineStr[:column-1])))}
+}
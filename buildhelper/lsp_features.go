@@ -0,0 +1,364 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// LSP completion item kinds
+const (
+	lspCompletionMethod    = 2
+	lspCompletionFunction  = 3
+	lspCompletionField     = 5
+	lspCompletionVariable  = 6
+	lspCompletionClass     = 7
+	lspCompletionInterface = 8
+	lspCompletionModule    = 9
+	lspCompletionConstant  = 21
+	lspCompletionStruct    = 22
+)
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// completion lists the members of the package or value before a dot at the position, or else the names in scope that
+// start with the identifier being written.
+func (s *lspServer) completion(params lspTextDocumentPositionParams) (interface{}, error) {
+	analysis, file, pos, err := s.locate(params)
+	if err != nil {
+		return nil, err
+	}
+	fset, info, pkg := analysis.checker.fset, analysis.checker.info[analysis.node], analysis.checker.checked[analysis.node]
+	text, err := s.sourceText(fset.File(file.Pos()).Name())
+	if err != nil {
+		return nil, err
+	}
+	offset := fset.File(file.Pos()).Offset(pos)
+	start := offset
+	for start > 0 && isIdentByte(text[start-1]) {
+		start--
+	}
+	prefix := text[start:offset]
+	items := []lspCompletionItem{} // Always serialize as a list
+	add := func(obj types.Object, qualifier types.Qualifier) {
+		if strings.HasPrefix(obj.Name(), prefix) && obj.Name() != "_" {
+			items = append(items, lspCompletionItem{Label: obj.Name(), Kind: completionKind(obj),
+				Detail: types.ObjectString(obj, qualifier)})
+		}
+	}
+	qualifier := types.RelativeTo(pkg)
+	if start > 0 && text[start-1] == '.' {
+		// Members of the expression before the dot
+		x := exprEndingAt(file, fset.File(file.Pos()).Pos(start-1))
+		if x == nil {
+			return items, nil
+		}
+		if id, ok := x.(*ast.Ident); ok {
+			if pkgName, ok := info.Uses[id].(*types.PkgName); ok {
+				scope := pkgName.Imported().Scope()
+				for _, name := range scope.Names() {
+					if obj := scope.Lookup(name); obj.Exported() {
+						add(obj, qualifier)
+					}
+				}
+				return items, nil
+			}
+		}
+		tv, ok := info.Types[x]
+		if !ok || tv.Type == nil {
+			return items, nil
+		}
+		for _, name := range memberNames(tv.Type) {
+			if obj, _, _ := types.LookupFieldOrMethod(tv.Type, true, pkg, name); obj != nil {
+				add(obj, qualifier)
+			}
+		}
+		return items, nil
+	}
+	// Names in scope (the innermost scope at the position, up to the universe)
+	seen := map[string]bool{}
+	innermost := pkg.Scope().Innermost(pos)
+	if innermost == nil {
+		innermost = pkg.Scope()
+	}
+	for scope := innermost; scope != nil; scope = scope.Parent() {
+		for _, name := range scope.Names() {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if _, obj := innermost.LookupParent(name, pos); obj != nil {
+				add(obj, qualifier)
+			}
+		}
+	}
+	return items, nil
+}
+
+// hover describes the identifier at the position: its declaration and its documentation.
+func (s *lspServer) hover(params lspTextDocumentPositionParams) (interface{}, error) {
+	analysis, file, pos, err := s.locate(params)
+	if err != nil {
+		return nil, err
+	}
+	id, obj := identAt(analysis, file, pos)
+	if obj == nil {
+		return nil, nil
+	}
+	contents := "```go\n" + types.ObjectString(obj, types.RelativeTo(analysis.checker.checked[analysis.node])) + "\n```"
+	if doc := s.declDoc(analysis.checker.fset.Position(obj.Pos()), obj.Name()); doc != "" {
+		contents += "\n\n" + doc
+	}
+	fset := analysis.checker.fset
+	text, err := s.sourceText(fset.File(file.Pos()).Name())
+	if err != nil {
+		return nil, err
+	}
+	idPos := fset.Position(id.Pos())
+	start := lspPositionOf(text, idPos.Line, idPos.Column)
+	end := lspPositionOf(text, idPos.Line, idPos.Column+len(id.Name))
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": contents},
+		"range":    lspRange{Start: start, End: end},
+	}, nil
+}
+
+// definition returns the declaration of the identifier at the position.
+func (s *lspServer) definition(params lspTextDocumentPositionParams) (interface{}, error) {
+	analysis, file, pos, err := s.locate(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, obj := identAt(analysis, file, pos); obj != nil {
+		if location, ok := s.location(analysis.checker.fset.Position(obj.Pos()), len(obj.Name())); ok {
+			return []lspLocation{location}, nil
+		}
+	}
+	return []lspLocation{}, nil
+}
+
+// references returns the uses (and optionally the declaration) of the identifier at the position, in the package of
+// the document and the packages of the user that it imports.
+func (s *lspServer) references(params lspTextDocumentPositionParams, includeDeclaration bool) (interface{}, error) {
+	analysis, file, pos, err := s.locate(params)
+	if err != nil {
+		return nil, err
+	}
+	locations := []lspLocation{}
+	_, obj := identAt(analysis, file, pos)
+	if obj == nil {
+		return locations, nil
+	}
+	fset := analysis.checker.fset
+	var positions []token.Position
+	for node, info := range analysis.checker.info {
+		if !isUserPackage(node, s.buildCtx) {
+			continue
+		}
+		for id, use := range info.Uses {
+			if sameObject(fset, use, obj) {
+				positions = append(positions, fset.Position(id.Pos()))
+			}
+		}
+		for id, def := range info.Defs {
+			if includeDeclaration && def != nil && sameObject(fset, def, obj) {
+				positions = append(positions, fset.Position(id.Pos()))
+			}
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].Filename != positions[j].Filename {
+			return positions[i].Filename < positions[j].Filename
+		}
+		return positions[i].Offset < positions[j].Offset
+	})
+	for i, p := range positions {
+		if i > 0 && p == positions[i-1] {
+			continue // Also declared by a type switch, for example
+		}
+		if location, ok := s.location(p, len(obj.Name())); ok {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
+
+// identAt returns the identifier at (or just before) the position, and the object that it declares or uses.
+func identAt(analysis *lspAnalysis, file *ast.File, pos token.Pos) (*ast.Ident, types.Object) {
+	var found *ast.Ident
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || found != nil || pos < n.Pos() || pos > n.End() {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			found = id
+		}
+		return true
+	})
+	if found == nil {
+		return nil, nil
+	}
+	info := analysis.checker.info[analysis.node]
+	if obj := info.Uses[found]; obj != nil {
+		return found, obj
+	}
+	return found, info.Defs[found]
+}
+
+// exprEndingAt returns the outermost expression that ends at the given position (e.g. before a dot), or nil.
+func exprEndingAt(file *ast.File, end token.Pos) ast.Expr {
+	var found ast.Expr
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || found != nil || end < n.Pos() || end > n.End() {
+			return false
+		}
+		if x, ok := n.(ast.Expr); ok && x.End() == end {
+			found = x
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// memberNames returns the names of the fields (also promoted ones) and methods of a type, or of the type it points to.
+func memberNames(t types.Type) []string {
+	var names []string
+	seen := map[types.Type]bool{}
+	var addFields func(t types.Type)
+	addFields = func(t types.Type) {
+		if ptr, ok := t.Underlying().(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		if st, ok := t.Underlying().(*types.Struct); ok {
+			for i := 0; i < st.NumFields(); i++ {
+				names = append(names, st.Field(i).Name())
+				if st.Field(i).Anonymous() {
+					addFields(st.Field(i).Type())
+				}
+			}
+		}
+	}
+	addFields(t)
+	methodSet := types.NewMethodSet(t)
+	if _, isPtr := t.Underlying().(*types.Pointer); !isPtr && !types.IsInterface(t) {
+		methodSet = types.NewMethodSet(types.NewPointer(t)) // Addressable values also have the pointer methods
+	}
+	for i := 0; i < methodSet.Len(); i++ {
+		names = append(names, methodSet.At(i).Obj().Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sameObject reports whether two objects are the same declaration (also when imported more than once).
+func sameObject(fset *token.FileSet, a, b types.Object) bool {
+	if a == b {
+		return true
+	}
+	if a.Pkg() == nil || b.Pkg() == nil || a.Pkg().Path() != b.Pkg().Path() || a.Name() != b.Name() {
+		return false
+	}
+	return a.Pos().IsValid() && fset.Position(a.Pos()) == fset.Position(b.Pos())
+}
+
+// completionKind returns the LSP completion item kind of an object.
+func completionKind(obj types.Object) int {
+	switch obj := obj.(type) {
+	case *types.Func:
+		if sig, ok := obj.Type().(*types.Signature); ok && sig.Recv() != nil {
+			return lspCompletionMethod
+		}
+		return lspCompletionFunction
+	case *types.Var:
+		if obj.IsField() {
+			return lspCompletionField
+		}
+		return lspCompletionVariable
+	case *types.Const:
+		return lspCompletionConstant
+	case *types.PkgName:
+		return lspCompletionModule
+	case *types.TypeName:
+		switch obj.Type().Underlying().(type) {
+		case *types.Struct:
+			return lspCompletionStruct
+		case *types.Interface:
+			return lspCompletionInterface
+		}
+		return lspCompletionClass
+	}
+	return lspCompletionVariable
+}
+
+// declDoc returns the documentation comment of the declaration of the given name at a position, parsing its source
+// file (objects imported from export data have no syntax).
+func (s *lspServer) declDoc(pos token.Position, name string) string {
+	if !pos.IsValid() {
+		return ""
+	}
+	fset := token.NewFileSet()
+	file, _ := s.srcs.parseFile(fset, s.sourcePath(pos.Filename), parser.ParseComments) // Partial on syntax errors
+	if file == nil {
+		return ""
+	}
+	matches := func(id *ast.Ident) bool { return id.Name == name && fset.Position(id.Pos()).Line == pos.Line }
+	var doc *ast.CommentGroup
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch d := n.(type) {
+		case *ast.FuncDecl:
+			if matches(d.Name) {
+				doc = d.Doc
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					if matches(spec.Name) {
+						doc = firstCommentGroup(spec.Doc, spec.Comment, d.Doc)
+					}
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						if matches(id) {
+							doc = firstCommentGroup(spec.Doc, spec.Comment, d.Doc)
+						}
+					}
+				}
+			}
+		case *ast.Field:
+			for _, id := range d.Names {
+				if matches(id) {
+					doc = firstCommentGroup(d.Doc, d.Comment)
+				}
+			}
+		}
+		return doc == nil
+	})
+	return strings.TrimSpace(doc.Text())
+}
+
+// firstCommentGroup returns the first comment group that is not nil.
+func firstCommentGroup(groups ...*ast.CommentGroup) *ast.CommentGroup {
+	for _, group := range groups {
+		if group != nil {
+			return group
+		}
+	}
+	return nil
+}
+
+// isIdentByte reports whether the byte may be part of an identifier (ASCII only).
+func isIdentByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go/build"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// moduleBuildList is the result of minimal version selection for the main module(s): the selected version of every
+// required module, and where to load it from.
+type moduleBuildList struct {
+	modules []module.Version
+	// replaces are the replace directives of the main module(s), with absolute local replacement directories
+	replaces []*modfile.Replace
+	// sums are the hashes of the module zips listed in the go.sum files of the main module(s) (and go.work.sum)
+	sums map[module.Version]string
+}
+
+// goModCache returns the module cache directory ($GOMODCACHE, or the pkg/mod directory of the first GOPATH entry).
+func goModCache(ctx build.Context) string {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir
+	}
+	goPaths := filepath.SplitList(ctx.GOPATH)
+	if len(goPaths) == 0 || goPaths[0] == "" {
+		return ""
+	}
+	return filepath.Join(goPaths[0], "pkg", "mod")
+}
+
+// goProxyDirs returns the local directories that provide module zips with the GOPROXY protocol: the download cache of
+// the module cache and every file:// entry of $GOPROXY (the other entries need network access and are ignored).
+func goProxyDirs(ctx build.Context) []string {
+	var dirs []string
+	if modCache := goModCache(ctx); modCache != "" {
+		dirs = append(dirs, filepath.Join(modCache, "cache", "download"))
+	}
+	for _, proxy := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(r rune) bool { return r == ',' || r == '|' }) {
+		if !strings.HasPrefix(proxy, "file://") {
+			continue
+		}
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			log.Println("Ignoring invalid GOPROXY entry:", proxy, err)
+			continue
+		}
+		dirs = append(dirs, filepath.FromSlash(proxyURL.Path))
+	}
+	return dirs
+}
+
+// loadModuleBuildList returns the (memoized) build list for the main module of buildDir, or for all the modules of its
+// go.work workspace. It returns nil if there is no main module.
+func loadModuleBuildList(buildDir string, srcs *sources, ctx build.Context) *moduleBuildList {
+	var goModFiles, goSumFiles []string
+	var replaces []*modfile.Replace
+	key := ""
+	if ws, _ := findAndParseGoWork(buildDir, srcs); ws != nil { // Errors are reported before parsing
+		key = ws.dir
+		for _, m := range ws.modules {
+			goModFiles = append(goModFiles, filepath.Join(m.dir, "go.mod"))
+			goSumFiles = append(goSumFiles, filepath.Join(m.dir, "go.sum"))
+		}
+		goSumFiles = append(goSumFiles, filepath.Join(ws.dir, "go.work.sum"))
+		replaces = ws.replaces
+	} else if goModDir, modulePath, goModReplaces := findAndParseGoMod(buildDir, srcs); modulePath != "" {
+		key = goModDir
+		goModFiles = append(goModFiles, filepath.Join(goModDir, "go.mod"))
+		goSumFiles = append(goSumFiles, filepath.Join(goModDir, "go.sum"))
+		replaces = goModReplaces
+	} else {
+		return nil
+	}
+	if buildList, ok := srcs.moduleBuildLists[key]; ok { // Needed for every import
+		return buildList
+	}
+	buildList := &moduleBuildList{replaces: replaces, sums: readGoSums(goSumFiles, srcs)}
+	var roots []module.Version
+	mainModules := map[string]bool{}
+	for _, goModFile := range goModFiles {
+		f, err := parseGoModFile(goModFile, srcs)
+		if err != nil {
+			log.Println("Error parsing go.mod file:", err)
+			continue
+		}
+		if f.Module != nil {
+			mainModules[f.Module.Mod.Path] = true
+		}
+		for _, r := range f.Require {
+			roots = append(roots, r.Mod)
+		}
+	}
+	buildList.modules = minimalVersionSelection(roots, mainModules, func(m module.Version) []module.Version {
+		return buildList.requirements(m, srcs, ctx)
+	})
+	srcs.moduleBuildLists[key] = buildList
+	return buildList
+}
+
+// minimalVersionSelection selects the maximum version of each module reachable from the roots in the requirement
+// graph (excluding the main modules), and returns them sorted by path.
+func minimalVersionSelection(roots []module.Version, mainModules map[string]bool, reqs func(module.Version) []module.Version) []module.Version {
+	selected := map[string]string{}
+	visited := map[module.Version]bool{}
+	pending := append([]module.Version{}, roots...)
+	for len(pending) > 0 {
+		m := pending[0]
+		pending = pending[1:]
+		if visited[m] || mainModules[m.Path] {
+			continue
+		}
+		visited[m] = true
+		if v, ok := selected[m.Path]; !ok || semver.Compare(m.Version, v) > 0 {
+			selected[m.Path] = m.Version
+		}
+		pending = append(pending, reqs(m)...)
+	}
+	var buildList []module.Version
+	for path, version := range selected {
+		buildList = append(buildList, module.Version{Path: path, Version: version})
+	}
+	sort.Slice(buildList, func(i, j int) bool { return buildList[i].Path < buildList[j].Path })
+	return buildList
+}
+
+// resolve applies the replacements of the main module(s) to the given module version.
+func (bl *moduleBuildList) resolve(m module.Version) module.Version {
+	replacement, _ := findReplacement(bl.replaces, m)
+	return replacement
+}
+
+// findDirForImport resolves an import path to the directory of the package in the module of the build list with the
+// longest matching path, extracting the module to the module cache if needed ("" if not found). Replaced modules are
+// also considered even if no module requires them. A module that fails verification is an error.
+func (bl *moduleBuildList) findDirForImport(importPath string, srcs *sources, ctx build.Context) (string, error) {
+	candidates := append([]module.Version{}, bl.modules...)
+	for _, r := range bl.replaces {
+		if !bl.has(r.Old.Path) {
+			candidates = append(candidates, r.Old)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return len(candidates[i].Path) > len(candidates[j].Path) })
+	for _, m := range candidates {
+		if importPath != m.Path && !strings.HasPrefix(importPath, m.Path+"/") {
+			continue
+		}
+		replacement := bl.resolve(m)
+		moduleDir, err := moduleDirFor(replacement, bl.sums[replacement], ctx)
+		if err != nil {
+			return "", err
+		}
+		if moduleDir != "" {
+			if dir := findPackageInModule(importPath, m.Path, moduleDir, srcs); dir != "" {
+				return dir, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// requirements returns the requirements of the given module version, from the go.mod file of its replacement if any.
+func (bl *moduleBuildList) requirements(m module.Version, srcs *sources, ctx build.Context) []module.Version {
+	replacement := bl.resolve(m)
+	if replacement.Version != "" {
+		return moduleRequirements(replacement, srcs, ctx)
+	}
+	// Local directory replacement: it must be a module with the replaced path
+	f, err := parseGoModFile(filepath.Join(replacement.Path, "go.mod"), srcs)
+	if err != nil {
+		log.Println("Error loading", m, "(replaced by", replacement.Path+"):", err)
+		return nil
+	}
+	if f.Module == nil || f.Module.Mod.Path != m.Path {
+		log.Println("Error loading", m, "(replaced by", replacement.Path+"): its go.mod file does not declare module", m.Path)
+		return nil
+	}
+	return requirementsOf(f)
+}
+
+func (bl *moduleBuildList) has(modulePath string) bool {
+	for _, m := range bl.modules {
+		if m.Path == modulePath {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleDirFor returns the directory with the sources of the given module version (a local directory replacement or
+// its module cache directory), unpacking its zip from a local proxy if it was not extracted yet ("" if unavailable).
+// Like the go command, a zip is only extracted if its hash matches sum, the hash of the module in go.sum: otherwise, it
+// is an error.
+func moduleDirFor(m module.Version, sum string, ctx build.Context) (string, error) {
+	if m.Version == "" { // Local directory replacement
+		return m.Path, nil
+	}
+	modCache := goModCache(ctx)
+	if modCache == "" {
+		return "", nil
+	}
+	escapedPath, err1 := module.EscapePath(m.Path)
+	escapedVersion, err2 := module.EscapeVersion(m.Version)
+	if err1 != nil || err2 != nil {
+		return "", nil
+	}
+	dir := filepath.Join(modCache, escapedPath+"@"+escapedVersion)
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		return dir, nil
+	}
+	for _, proxyDir := range goProxyDirs(ctx) {
+		zipFile := filepath.Join(proxyDir, escapedPath, "@v", escapedVersion+".zip")
+		if _, err := os.Stat(zipFile); err != nil {
+			continue
+		}
+		if err := checkModuleZipSum(m, zipFile, sum); err != nil {
+			return "", err
+		}
+		log.Println("Extracting module", m.Path+"@"+m.Version, "from", zipFile)
+		if err := modzip.Unzip(dir, m, zipFile); err != nil {
+			_ = os.RemoveAll(dir) // Do not leave a partially extracted module
+			return "", fmt.Errorf("extracting %s@%s: %v", m.Path, m.Version, err)
+		}
+		return dir, nil
+	}
+	return "", nil
+}
+
+// checkModuleZipSum verifies the zip of the given module version against its hash in go.sum, like the go command does
+// before extracting it.
+func checkModuleZipSum(m module.Version, zipFile, sum string) error {
+	if sum == "" {
+		return fmt.Errorf("verifying %s@%s: missing go.sum entry", m.Path, m.Version)
+	}
+	zipSum, err := dirhash.HashZip(zipFile, dirhash.Hash1)
+	if err != nil {
+		return fmt.Errorf("verifying %s@%s: %v", m.Path, m.Version, err)
+	}
+	if zipSum != sum {
+		return fmt.Errorf("verifying %s@%s: checksum mismatch\n\tdownloaded: %s\n\tgo.sum:     %s", m.Path, m.Version,
+			zipSum, sum)
+	}
+	return nil
+}
+
+// readGoSums returns the hashes of the module zips listed in the given go.sum files (missing files are skipped). Only
+// the zips are verified: the lines of the go.mod files of the modules are skipped.
+func readGoSums(goSumFiles []string, srcs *sources) map[module.Version]string {
+	sums := map[module.Version]string{}
+	for _, goSumFile := range goSumFiles {
+		data, err := srcs.readFile(goSumFile)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") || !strings.HasPrefix(fields[2], "h1:") {
+				continue
+			}
+			sums[module.Version{Path: fields[0], Version: fields[1]}] = fields[2]
+		}
+	}
+	return sums
+}
+
+// moduleRequirements returns the requirements listed in the go.mod file of the given module version from the module
+// cache or local proxies (nil if its go.mod file is not available locally).
+func moduleRequirements(m module.Version, srcs *sources, ctx build.Context) []module.Version {
+	var goModFiles []string
+	if escapedPath, err := module.EscapePath(m.Path); err == nil {
+		escapedVersion, _ := module.EscapeVersion(m.Version)
+		for _, proxyDir := range goProxyDirs(ctx) {
+			goModFiles = append(goModFiles, filepath.Join(proxyDir, escapedPath, "@v", escapedVersion+".mod"))
+		}
+		if modCache := goModCache(ctx); modCache != "" {
+			goModFiles = append(goModFiles, filepath.Join(modCache, escapedPath+"@"+escapedVersion, "go.mod"))
+		}
+	}
+	for _, goModFile := range goModFiles {
+		if _, err := os.Stat(goModFile); err != nil {
+			continue
+		}
+		f, err := parseGoModFile(goModFile, srcs)
+		if err != nil {
+			log.Println("Error parsing go.mod file:", err)
+			return nil
+		}
+		return requirementsOf(f)
+	}
+	log.Println("Missing go.mod file for module", m.Path+"@"+m.Version, "in the module cache or local proxies")
+	return nil
+}
+
+func requirementsOf(f *modfile.File) []module.Version {
+	var reqs []module.Version
+	for _, r := range f.Require {
+		reqs = append(reqs, r.Mod)
+	}
+	return reqs
+}
+
+func parseGoModFile(goModFile string, srcs *sources) (*modfile.File, error) {
+	data, err := srcs.readFile(goModFile)
+	if err != nil {
+		return nil, err
+	}
+	return modfile.ParseLax(goModFile, data, nil)
+}
+
+// parseMainGoModFile parses the go.mod file of a main module, including the replace directives that only apply to main
+// modules. modfile.Parse is not used for the whole file as it rejects any directive newer than the x/mod version.
+func parseMainGoModFile(goModFile string, srcs *sources) (*modfile.File, error) {
+	f, err := parseGoModFile(goModFile, srcs)
+	if err != nil {
+		return nil, err
+	}
+	// Parse the replace directives on their own, as they are ignored by modfile.ParseLax
+	replaces := &modfile.FileSyntax{}
+	for _, stmt := range f.Syntax.Stmt {
+		switch x := stmt.(type) {
+		case *modfile.Line:
+			if x.Token[0] == "replace" {
+				replaces.Stmt = append(replaces.Stmt, x)
+			}
+		case *modfile.LineBlock:
+			if x.Token[0] == "replace" {
+				replaces.Stmt = append(replaces.Stmt, x)
+			}
+		}
+	}
+	replacesFile, err := modfile.Parse(goModFile, modfile.Format(replaces), nil)
+	if err != nil {
+		return nil, err
+	}
+	f.Replace = replacesFile.Replace
+	return f, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,28 +12,46 @@ import (
 	"strings"
 )
 
-func output(commands [][]string, buildDir string, err error) {
-	for _, command := range commands {
-		println("Command: " + strings.Join(command, " "))
+// output writes the build plan to plan.json (also printing its actions if printActions). Actions are listed in a valid
+// execution order (dependencies first), so they may also be run one after another.
+func output(actions []*action, buildDir string, srcs *sources, printActions bool) {
+	for i, a := range actions {
+		if printActions {
+			log.Println("Action: " + a.ID + " (after " + strings.Join(a.Deps, ", ") + "): " + strings.Join(a.Command, " "))
+		}
 		// Also run commands
 		if os.Getenv("ALSO_EXECUTE_COMMANDS") != "" {
-			cmd := exec.Command("go", append([]string{"tool"}, command...)...)
+			cmd := exec.Command("go", append([]string{"tool"}, a.Command...)...)
 			cmd.Env = append(os.Environ(), "GOOS", "js", "GOARCH", "wasm")
+			cmd.Env = append(cmd.Env, a.Env...)
 			cmd.Dir = buildDir
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
+			var toolOutput bytes.Buffer
+			cmd.Stdout = io.MultiWriter(os.Stdout, &toolOutput)
+			cmd.Stderr = io.MultiWriter(os.Stderr, &toolOutput)
+			if err := cmd.Run(); err != nil {
+				removeUnfinishedOutputs(actions[i:])
+				writeDiagnostics(buildDir, toolDiagnostics(a, toolOutput.String(), srcs))
 				log.Fatal(err)
 			}
 		}
 	}
-	marshal, err := json.MarshalIndent(commands, "", "    ")
+	marshal, err := json.MarshalIndent(actions, "", "    ")
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = ioutil.WriteFile(filepath.Join(buildDir, "commands.json"), marshal, 0644)
+	err = ioutil.WriteFile(filepath.Join(buildDir, "plan.json"), marshal, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// removeUnfinishedOutputs deletes all outputs of the given (failed or not executed) actions. Outputs may be written by
+// more than one action (e.g. assembly is packed into the compiled archive), so they would otherwise be reused as valid
+// cache entries by later builds.
+func removeUnfinishedOutputs(actions []*action) {
+	for _, a := range actions {
+		for _, out := range a.Outputs {
+			_ = os.Remove(out)
+		}
+	}
+}
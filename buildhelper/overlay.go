@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// overlayFile is the JSON format of the overlay file of the go command (go build -overlay): it maps source file paths
+// to the paths of the files with their contents, or to "" if they are deleted. Relative paths are relative to the
+// current directory.
+type overlayFile struct {
+	Replace map[string]string
+}
+
+// loadOverlay reads an overlay file, replacing the contents of (or adding, or deleting) the listed source files.
+func (srcs *sources) loadOverlay(overlayPath string) error {
+	data, err := ioutil.ReadFile(overlayPath)
+	if err != nil {
+		return err
+	}
+	var overlay overlayFile
+	if err = json.Unmarshal(data, &overlay); err != nil {
+		return fmt.Errorf("parsing overlay file %s: %v", overlayPath, err)
+	}
+	for from, to := range overlay.Replace {
+		fromAbs, err := filepath.Abs(from)
+		if err != nil {
+			return err
+		}
+		if to != "" {
+			if to, err = filepath.Abs(to); err != nil {
+				return err
+			}
+		}
+		srcs.addOverlay(fromAbs, to)
+	}
+	return nil
+}
+
+// addOverlay replaces the contents of the source file at the absolute path from with those of the file at the absolute
+// path to ("" to delete it).
+func (srcs *sources) addOverlay(from, to string) {
+	srcs.overlay[from] = to
+	srcs.resetMemos() // go.mod files or the standard library may be edited
+	for child, dir := from, filepath.Dir(from); dir != child; child, dir = dir, filepath.Dir(dir) {
+		if srcs.overlayDirs[dir] == nil {
+			srcs.overlayDirs[dir] = map[string]bool{}
+		}
+		srcs.overlayDirs[dir][filepath.Base(child)] = true
+	}
+}
+
+// removeOverlay restores the contents of an overlaid source file (at an absolute path). Its entry is removed from the
+// same directories as addOverlay added it to, up to the first one that still has other overlaid entries.
+func (srcs *sources) removeOverlay(p string) {
+	delete(srcs.overlay, p)
+	srcs.resetMemos()
+	for child, dir := p, filepath.Dir(p); dir != child; child, dir = dir, filepath.Dir(dir) {
+		if _, overlaid := srcs.overlay[child]; overlaid || srcs.overlayDirs[child] != nil {
+			return
+		}
+		entries := srcs.overlayDirs[dir]
+		delete(entries, filepath.Base(child))
+		if len(entries) > 0 {
+			return
+		}
+		delete(srcs.overlayDirs, dir)
+	}
+}
+
+// actualSourcePath returns the path of the file with the contents of the given source file: its replacement if it is
+// overlaid, or itself otherwise. The tools must be given actual paths.
+func (srcs *sources) actualSourcePath(p string) string {
+	if replacement := srcs.overlay[filepath.Clean(p)]; replacement != "" {
+		return replacement
+	}
+	return p
+}
+
+// overlayCompileFile returns the Go file that the compiler must read for the given source file: itself, or for an
+// overlaid file a copy of its replacement in the build directory, starting with a //line directive so that all
+// positions (in errors and debug information) refer to the overlaid file.
+func (srcs *sources) overlayCompileFile(p, buildDir string) (string, error) {
+	actual := srcs.actualSourcePath(p)
+	if actual == p || p == srcs.instrumentationFile { // Positions in the generated instrumentation refer to itself
+		return actual, nil
+	}
+	contents, err := ioutil.ReadFile(actual)
+	if err != nil {
+		return "", err
+	}
+	copyPath := filepath.Join(buildDir, "_overlay_"+hashString(p), filepath.Base(p))
+	srcs.overlayCopies[copyPath] = p
+	if err = os.MkdirAll(filepath.Dir(copyPath), 0755); err != nil {
+		return "", err
+	}
+	return copyPath, ioutil.WriteFile(copyPath, append([]byte("//line "+p+":1:1\n"), contents...), 0644)
+}
+
+// originalSourcePath returns the overlaid source file of a path reported by a tool, if it is the replacement of one or
+// its copy (see overlayCompileFile), or the path itself otherwise.
+func (srcs *sources) originalSourcePath(p string) string {
+	if original, ok := srcs.overlayCopies[filepath.Clean(p)]; ok {
+		return original
+	}
+	for original, replacement := range srcs.overlay {
+		if replacement != "" && replacement == filepath.Clean(p) {
+			return original
+		}
+	}
+	return p
+}
+
+// overlayTrimPath returns the -trimpath rewrites of the asm tool that make positions refer to the overlaid assembly
+// files of a package instead of their replacements ("" if none is overlaid).
+func (srcs *sources) overlayTrimPath(dir string, fileNames []string) string {
+	var rewrites []string
+	for _, name := range fileNames {
+		original := filepath.Join(dir, name)
+		if actual := srcs.actualSourcePath(original); actual != original {
+			rewrites = append(rewrites, actual+"=>"+original)
+		}
+	}
+	return strings.Join(rewrites, ";")
+}
+
+// overlayStat returns the file info of an overlaid file path, and whether the path is overlaid at all: if not, the
+// mounted file systems or the OS must be checked.
+func (srcs *sources) overlayStat(p string) (os.FileInfo, bool, error) {
+	p = filepath.Clean(p)
+	replacement, ok := srcs.overlay[p]
+	if !ok {
+		return nil, false, nil
+	}
+	if replacement == "" {
+		return nil, true, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	info, err := os.Stat(replacement)
+	if err != nil {
+		return nil, true, err
+	}
+	return renamedFileInfo{FileInfo: info, name: filepath.Base(p)}, true, nil
+}
+
+// overlayReadDir applies the overlay to the entries of a directory, that may not exist without the overlay.
+func (srcs *sources) overlayReadDir(dir string, entries []os.FileInfo, err error) ([]os.FileInfo, error) {
+	overlaid, ok := srcs.overlayDirs[filepath.Clean(dir)]
+	if !ok {
+		return entries, err
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	byName := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		byName[entry.Name()] = entry
+	}
+	for name := range overlaid {
+		child := filepath.Join(dir, name)
+		if info, isFile, err := srcs.overlayStat(child); isFile {
+			delete(byName, name)
+			if err == nil {
+				byName[name] = info
+			}
+		} else if existing, ok := byName[name]; !ok || !existing.IsDir() {
+			byName[name] = sourceDirInfo(name) // Only contains overlaid files
+		}
+	}
+	res := make([]os.FileInfo, 0, len(byName))
+	for _, info := range byName {
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+// renamedFileInfo is the file info of a replacement file, with the name of the overlaid file.
+type renamedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedFileInfo) Name() string { return fi.name }
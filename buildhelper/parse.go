@@ -8,7 +8,7 @@ import (
 	"go/parser"
 	"go/token"
 	"golang.org/x/mod/modfile"
-	"io/ioutil"
+	"golang.org/x/mod/module"
 	"log"
 	"os"
 	"path/filepath"
@@ -21,65 +21,123 @@ type parsedTreeNode struct {
 	goFileNames                 []string
 	assemblyFileNames           []string
 	validPrecompiledArchivePath string
+	embedCfg                    *embedCfg         // nil if the package does not embed any file
+	parsingImport               *importStep       // the import being parsed, while parsing the imports (to report cycles)
+	generated                   bool              // generated by buildhelper (exempt from the import visibility rules)
+	cgoImports                  []token.Position  // the import "C" of each file that requires cgo (skipped unless it is enabled)
+	goVersion                   string            // Go language version of the module of the package ("" if unknown)
+	goDebug                     []string          // settings of the //go:debug directives (main and test packages)
+	actionID                    string            // content-based ID of the compile action (set while compiling)
 	imports                     []*parsedTreeNode // all of this package's imports (including repeated ones)
+	importMap                   map[string]string // actual import path of the imports written with another path (see stdImportPath)
+	planName                    string            // names the package in the plan instead of its import path, if ambiguous (see planName)
 }
 
-func parse(buildDir string, tmpBuildDir string, buildCtx build.Context) (*parsedTreeNode, bool, error) {
+// importStep is an import of a package, with the position of the import declaration.
+type importStep struct {
+	importPath, dir string
+	pos             token.Position
+}
+
+// testFiles selects the test files of a package directory that are parsed
+type testFiles int
+
+const (
+	noTestFiles       testFiles = iota
+	internalTestFiles           // the package files and the _test.go files of the same package
+	externalTestFiles           // only the _test.go files of the external test package (package <name>_test)
+)
+
+func parse(buildDir string, srcs *sources, buildCtx build.Context) (*parsedTreeNode, bool, error) {
 	// buildCtx.ImportDir() would avoid duplication and handle tags and edge cases, so why not?
 	//  - Because it executes go list, which is available, but requires GOCACHE to be populated.
 	fset := token.NewFileSet()
+	buildCtx = srcs.buildContext(buildCtx)
 	buildDirAbs, err := filepath.Abs(buildDir)
 	if err != nil {
 		return nil, false, err
 	}
-	_, err = os.Stat(goPkgPath(buildCtx))
-	precompiledInternal := err == nil // Performance: assume a proper and complete precompiled standard library structure if this directory exists
-	res, err := parseRecursive(fset, buildDirAbs, "main", buildDirAbs, tmpBuildDir, buildCtx, false, precompiledInternal, map[string]*parsedTreeNode{})
+	if _, err = findAndParseGoWork(buildDirAbs, srcs); err != nil {
+		return nil, false, err
+	}
+	if err = checkVendorConsistency(buildDirAbs, srcs); err != nil {
+		return nil, false, err
+	}
+	precompiledInternal := hasPrecompiledStd(buildCtx)
+	res, err := parseRecursive(fset, buildDirAbs, "main", buildDirAbs, srcs, buildCtx, false, precompiledInternal, noTestFiles, map[string]*parsedTreeNode{})
 	if err != nil {
 		return nil, false, err
 	}
-	// Post-process to remove caches if any descendant is not cached
-	invalidateCachesRecursive(res, map[*parsedTreeNode]bool{})
+	if err = checkCgo(res, srcs, buildCtx); err != nil {
+		return nil, false, err
+	}
 	return res, precompiledInternal, err
 }
 
-func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir, tmpBuildDir string, buildCtx build.Context, isInternal, precompiledInternal bool, explored map[string]*parsedTreeNode) (*parsedTreeNode, error) {
+// hasPrecompiledStd reports whether the standard library is precompiled for the target (and its variant).
+func hasPrecompiledStd(buildCtx build.Context) bool {
+	if _, err := os.Stat(goPkgPath(buildCtx)); err != nil {
+		return false // Performance: assume a proper and complete precompiled standard library structure if this directory exists
+	}
+	if !precompiledStdMatches(buildCtx) {
+		log.Println("The precompiled standard library was built for another variant of", buildCtx.GOARCH+",",
+			"building it from source for", strings.Join(subArchSettings(buildCtx), " "))
+		return false
+	}
+	return true
+}
+
+func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir string, srcs *sources, buildCtx build.Context, isInternal, precompiledInternal bool, tests testFiles, explored map[string]*parsedTreeNode) (*parsedTreeNode, error) {
 	// Also handle files as input for root node (like when there are several examples with func main() on the same directory, but only one is wanted)
-	stat, err := os.Stat(pkgDirOrFile)
+	stat, err := srcs.stat(pkgDirOrFile)
 	if err != nil {
 		return nil, err
 	}
 	var pkgs map[string]*ast.Package
 	pkgDir := pkgDirOrFile
 	if stat.IsDir() {
-		pkgs, err = parser.ParseDir(fset, pkgDirOrFile, nil, parser.ImportsOnly)
+		pkgs, err = srcs.parseDir(fset, pkgDirOrFile, parser.ImportsOnly)
 		if err != nil {
-			return nil, err
+			return nil, &packageError{importPath: impPath, err: err}
 		}
 	} else {
 		pkgDir = filepath.Dir(pkgDirOrFile)
 		buildDir = filepath.Dir(buildDir)
-		file, err := parser.ParseFile(fset, pkgDirOrFile, nil, parser.ImportsOnly)
+		files, file, err := parseInputFiles(fset, append([]string{pkgDirOrFile}, srcs.moreInputFiles...), srcs)
 		if err != nil {
-			return nil, err
+			return nil, &packageError{importPath: impPath, err: err}
+		}
+		if srcs.instrumentationFile != "" && impPath == "main" { // The generated file joins the input file
+			if files[srcs.instrumentationFile], err = srcs.parseFile(fset, srcs.instrumentationFile, parser.ImportsOnly); err != nil {
+				return nil, &packageError{importPath: impPath, err: err}
+			}
 		}
 		pkgs = map[string]*ast.Package{
 			"main": {
 				Name:    "main",
 				Scope:   file.Scope,
 				Imports: nil, // We do not use this
-				Files:   map[string]*ast.File{pkgDirOrFile: file},
+				Files:   files,
 			},
 		}
 	}
 	// Filter main/test/etc. packages (based on package name as there may be multiple packages in a directory)
 	for pkgName := range pkgs {
-		if impPath != "main" && pkgName == "main" || strings.Contains(pkgName, "_test") {
+		isExternalTest := strings.HasSuffix(pkgName, "_test")
+		if tests == externalTestFiles {
+			if !isExternalTest {
+				delete(pkgs, pkgName)
+			}
+		} else if impPath != "main" && pkgName == "main" && tests == noTestFiles || isExternalTest {
 			delete(pkgs, pkgName)
 		}
 	}
+	if len(pkgs) == 0 && tests == externalTestFiles {
+		return nil, nil // No external tests
+	}
 	if len(pkgs) == 0 {
-		return nil, errors.New("Import \"" + impPath + "\" had no matching packages in expected directory " + pkgDirOrFile)
+		return nil, &packageError{importPath: impPath,
+			err: errors.New("Import \"" + impPath + "\" had no matching packages in expected directory " + pkgDirOrFile)}
 	}
 	// We expect only one package to match the import path
 	var pkg *ast.Package
@@ -88,7 +146,8 @@ func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir, tmpBui
 		expectedPkgName := impPath[strings.LastIndex(impPath, "/")+1:]
 		foundPkg, ok := pkgs[expectedPkgName]
 		if !ok {
-			return nil, fmt.Errorf("more than one package found %v for %s", pkgs, pkgDirOrFile)
+			return nil, &packageError{importPath: impPath,
+				err: fmt.Errorf("more than one package found %v for %s", pkgs, pkgDirOrFile)}
 		}
 		pkg = foundPkg
 	} else {
@@ -98,11 +157,7 @@ func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir, tmpBui
 		}
 	}
 	// Add all assembly files in dir as source (will be filtered by os/arch later)
-	dir, err := os.Open(pkgDir)
-	if err != nil {
-		return nil, err
-	}
-	dirEntries, err := dir.Readdir(-1)
+	dirEntries, err := srcs.readDir(pkgDir)
 	if err != nil {
 		return nil, err
 	}
@@ -122,20 +177,48 @@ func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir, tmpBui
 		assemblyFileNames:           nil, // Later
 		validPrecompiledArchivePath: "",  // Later
 		imports:                     nil, // Later
+		goVersion:                   packageGoVersion(pkgDir, buildDir, isInternal, srcs),
+	}
+	if tests != externalTestFiles { // The external test package shares the directory with the package under test
+		explored[pkgDirOrFile] = node // Mark as explored (avoid infinite loops)
 	}
+	var embedPatterns []embedPattern
 	for filePath, file := range pkg.Files {
-		// Check if the file matches build constraints or skip it
+		// Check if the file matches build constraints or skip it (the Go files named as input are always used)
 		fileName := filepath.Base(filePath)
-		if ok, err := buildCtx.MatchFile(filepath.Dir(filePath), fileName); !ok || err != nil {
+		namedFile := !stat.IsDir() && strings.HasSuffix(fileName, ".go")
+		if ok, err := buildCtx.MatchFile(filepath.Dir(filePath), fileName); !namedFile && (!ok || err != nil) {
 			continue
 		}
-		// Ignore _test files for now. TODO: Support running tests?
-		if strings.Contains(fileName, "_test") {
+		// Ignore _test files unless building tests
+		if tests == noTestFiles && strings.HasSuffix(fileName, "_test.go") {
 			continue
 		}
+		// Files that require cgo are ignored if cgo is disabled (like the go command), and reported by checkCgo if they
+		// are selected or have no fallback
+		if strings.HasSuffix(strings.ToLower(fileName), ".go") {
+			if cgoPos := cgoImportPos(fset, file); cgoPos.IsValid() {
+				node.cgoImports = append(node.cgoImports, cgoPos)
+				if !buildCtx.CgoEnabled {
+					continue
+				}
+			}
+		}
 		// Register the file
 		if strings.HasSuffix(strings.ToLower(fileName), ".go") {
 			node.goFileNames = append(node.goFileNames, fileName)
+			filePatterns, err := parseEmbedPatterns(fset, filePath, file, srcs)
+			if err != nil {
+				return nil, &packageError{importPath: impPath, err: err}
+			}
+			embedPatterns = append(embedPatterns, filePatterns...)
+			if impPath == "main" || tests != noTestFiles { // Only the main and test packages may set GODEBUG
+				goDebug, err := parseGoDebugDirectives(fset, filePath, srcs)
+				if err != nil {
+					return nil, &packageError{importPath: impPath, err: err}
+				}
+				node.goDebug = append(node.goDebug, goDebug...)
+			}
 		} else if strings.HasSuffix(strings.ToLower(fileName), ".s") {
 			node.assemblyFileNames = append(node.assemblyFileNames, fileName)
 		} else {
@@ -145,176 +228,297 @@ func parseRecursive(fset *token.FileSet, pkgDirOrFile, impPath, buildDir, tmpBui
 		// Handle the imports
 		for _, imp := range file.Imports {
 			importPath := imp.Path.Value[1 : len(imp.Path.Value)-1]
-			if importPath == "unsafe" || importPath == "C" {
-				continue
-			}
-			importDir, internal, precompiled := parseFindDirForImport(importPath, buildDir, tmpBuildDir, buildCtx.GOPATH, buildCtx)
-			if importDir == "" {
-				return nil, errors.New("Import \"" + importPath + "\" not found in standard locations " +
-					"(make sure the output of `go mod vendor` is included and updated!)")
-			}
-			if precompiledInternal && internal { // Avoid exploration of the precompiled standard library if available (assume OK for performance)
-				continue
-			}
-			if exploredData, alreadyExplored := explored[importDir]; alreadyExplored {
-				// Mark dependency (to properly compile in order)
-				alreadyRegistered := false
-				for _, dep := range node.imports {
-					if dep == exploredData {
-						alreadyRegistered = true
-						break
-					}
-				}
-				if !alreadyRegistered {
-					node.imports = append(node.imports, exploredData)
-					// TODO: check that there are no import cycles (the compiler will fail later anyway)
-				}
-			} else {
-				child, err := parseRecursive(fset, importDir, importPath, buildDir, tmpBuildDir, buildCtx, internal, precompiledInternal, explored)
-				if err != nil {
-					return nil, err
-				}
-				child.dir = importDir
-				child.validPrecompiledArchivePath = precompiled // "" means not precompiled
-				node.imports = append(node.imports, child)
-				explored[importDir] = node // Mark as explored (avoid infinite loops)
+			importPos := fset.Position(imp.Path.Pos())
+			if err = parseImport(fset, node, importPath, importPos, buildDir, srcs, buildCtx, precompiledInternal, explored); err != nil {
+				return nil, err
 			}
 		}
 	}
+	if len(embedPatterns) > 0 {
+		node.embedCfg, err = resolveEmbedPatterns(pkgDir, embedPatterns, srcs)
+		if err != nil {
+			return nil, &packageError{importPath: impPath, err: err}
+		}
+	}
 	return node, err
 }
 
-func invalidateCachesRecursive(node *parsedTreeNode, exploredAndCached map[*parsedTreeNode]bool) bool {
-	// Check if it was already compiled (more than one node depends on this package, and it was already processed) and skip
-	if v, ok := exploredAndCached[node]; ok {
-		return v
-	}
-	exploredAndCached[node] = true
-	// Explore dependencies, to know if we should invalidate the cache for this node
-	for _, dep := range node.imports {
-		if !invalidateCachesRecursive(dep, exploredAndCached) {
-			// Disable the cache of the parent
-			node.validPrecompiledArchivePath = ""
-		}
-	}
-	// And notify parents recursively
-	cached := node.validPrecompiledArchivePath != ""
-	exploredAndCached[node] = cached
-	return cached
+// parseInputFiles parses the .go files given as the main package (with imports only), returning them by path, and the
+// first one. Like go run, they are not filtered by build constraints, but they must be in the same directory and share
+// the same package clause.
+func parseInputFiles(fset *token.FileSet, filePaths []string, srcs *sources) (map[string]*ast.File, *ast.File, error) {
+	files := map[string]*ast.File{}
+	var first *ast.File
+	for _, filePath := range filePaths {
+		if strings.HasSuffix(filePath, "_test.go") {
+			return nil, nil, fmt.Errorf("cannot build *_test.go files (%s) as the main package", filePath)
+		}
+		if filepath.Dir(filePath) != filepath.Dir(filePaths[0]) {
+			return nil, nil, fmt.Errorf("named files must all be in one directory; have %s and %s",
+				filepath.Dir(filePaths[0]), filepath.Dir(filePath))
+		}
+		file, err := srcs.parseFile(fset, filePath, parser.ImportsOnly)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = file
+		} else if file.Name.Name != first.Name.Name {
+			return nil, nil, fmt.Errorf("found packages %s (%s) and %s (%s) in %s", first.Name.Name,
+				filepath.Base(filePaths[0]), file.Name.Name, filepath.Base(filePath), filepath.Dir(filePath))
+		}
+		files[filePath] = file
+	}
+	return files, first, nil
 }
 
-func parseFindDirForImport(importPath, buildDir, tmpBuildDir, goPath string, ctx build.Context) (dirOrArchive string, isInternal bool, precompiledArchive string) {
-	// Check path relative to Go module (get go module name and remove prefix)
-	goModDir, importPathGoMod, replaces := findAndParseGoMod(buildDir)
-	if importPathGoMod != "" {
-		// Apply go.mod package import path replacements
-		for from, to := range replaces {
-			if strings.HasPrefix(importPath, from) {
-				importPath = to + importPath[len(from):]
-				break
-			}
+// parseImport resolves the import of node (parsing it if it was not explored yet) and registers it as a dependency.
+func parseImport(fset *token.FileSet, node *parsedTreeNode, importPath string, importPos token.Position, buildDir string, srcs *sources, buildCtx build.Context, precompiledInternal bool, explored map[string]*parsedTreeNode) error {
+	if importPath == "unsafe" || importPath == "C" {
+		return nil
+	}
+	var importDir, precompiled string
+	var internal bool
+	gopath := !node.internal && gopathMode(buildDir, srcs)
+	if node.internal { // The standard library only imports standard packages (or those it vendors)
+		importDir, precompiled = parseFindStdDirForImport(importPath, srcs, buildCtx)
+		internal = importDir != ""
+	} else if gopath {
+		importDir, internal, precompiled = parseFindGopathDirForImport(importPath, node.dir, buildDir, srcs, buildCtx)
+	} else {
+		var err error
+		if importDir, internal, precompiled, err = parseFindDirForImport(importPath, buildDir, buildCtx.GOPATH, srcs, buildCtx); err != nil {
+			return &packageError{importPath: node.importPath, pos: importPos, err: err}
+		}
+	}
+	if importDir == "" {
+		return &packageError{importPath: node.importPath, pos: importPos,
+			err: errors.New("Import \"" + importPath + "\" not found in standard locations " +
+				"(make sure the output of `go mod vendor` is included and updated!)")}
+	}
+	actualPath := importPath
+	if internal {
+		actualPath = stdImportPath(importPath, importDir, buildCtx)
+	} else if gopath { // Vendored packages have their full path (see parseFindGopathDirForImport)
+		if actualPath = gopathImportPath(importDir, buildCtx); actualPath == "" {
+			actualPath = "_" + filepath.ToSlash(importDir) // Vendored by a main package outside of GOPATH
+		}
+	}
+	if err := checkImportVisibility(node, importPath, actualPath, importDir, internal, srcs, buildCtx); err != nil {
+		return &packageError{importPath: node.importPath, pos: importPos, err: err}
+	}
+	if actualPath != importPath {
+		if node.importMap == nil {
+			node.importMap = map[string]string{}
 		}
-		// Perform the actual check
-		subImportPath := strings.TrimPrefix(importPath, importPathGoMod)
-		if subImportPath != importPath {
-			modulePath := filepath.Join(goModDir, subImportPath)
-			if stat, err := os.Stat(modulePath); err == nil && stat.IsDir() {
-				return modulePath, false, checkPrecompiledCache(tmpBuildDir, importPath, modulePath)
+		node.importMap[importPath] = actualPath
+	}
+	if precompiledInternal && internal {
+		if !stdPackageStale(actualPath, srcs, buildCtx) { // Avoid exploration of the precompiled standard library if available (assume OK for performance)
+			return nil
+		}
+		precompiled = "" // Edited, so compiled from sources like its importers
+	}
+	node.parsingImport = &importStep{importPath: importPath, dir: importDir, pos: importPos}
+	defer func() { node.parsingImport = nil }()
+	if exploredData, alreadyExplored := explored[importDir]; alreadyExplored {
+		if exploredData.parsingImport != nil { // Still parsing its imports, so it (indirectly) imports this package
+			return &packageError{importPath: node.importPath, pos: importPos, err: importCycleError(exploredData, explored)}
+		}
+		// Mark dependency (to properly compile in order)
+		for _, dep := range node.imports {
+			if dep == exploredData {
+				return nil // Already registered
 			}
 		}
+		node.imports = append(node.imports, exploredData)
+		return nil
+	}
+	child, err := parseRecursive(fset, importDir, actualPath, buildDir, srcs, buildCtx, internal, precompiledInternal, noTestFiles, explored)
+	if err != nil {
+		return err
+	}
+	child.dir = importDir
+	if precompiledInternal || !internal {
+		child.validPrecompiledArchivePath = precompiled // "" means not precompiled (may still be cached, see compile)
+	}
+	node.imports = append(node.imports, child)
+	return nil
+}
+
+// importCycleError reports the import cycle that starts and ends at the given package, following the imports that are
+// being parsed, with the position of each import.
+func importCycleError(start *parsedTreeNode, explored map[string]*parsedTreeNode) error {
+	chain := []string{start.importPath}
+	var details []string
+	for node := start; ; {
+		step := node.parsingImport
+		chain = append(chain, step.importPath)
+		details = append(details, fmt.Sprintf("%s imports %s at %s", node.importPath, step.importPath, step.pos))
+		node = explored[step.dir]
+		if node == start {
+			break
+		}
+	}
+	return errors.New("import cycle not allowed: " + strings.Join(chain, " -> ") + "\n\t" + strings.Join(details, "\n\t"))
+}
+
+func parseFindDirForImport(importPath, buildDir, goPath string, srcs *sources, ctx build.Context) (dirOrArchive string, isInternal bool, precompiledArchive string, err error) {
+	// Check the modules of the go.work workspace, if any
+	if ws, _ := findAndParseGoWork(buildDir, srcs); ws != nil { // Errors are reported before parsing
+		if workspaceDir := ws.findDirForImport(importPath, srcs); workspaceDir != "" {
+			return workspaceDir, false, "", nil
+		}
+	}
+	// Check path relative to Go module (get go module name and remove prefix)
+	goModDir, importPathGoMod, _ := findAndParseGoMod(buildDir, srcs)
+	if importPathGoMod != "" {
+		if moduleDir := findPackageInModule(importPath, importPathGoMod, goModDir, srcs); moduleDir != "" {
+			return moduleDir, false, "", nil
+		}
 	}
 	// Check vendor directory.
 	buildModDir := buildDir
 	if goModDir != "" {
 		buildModDir = goModDir
 	}
-	vendorPath := filepath.Join(buildModDir, "vendor", importPath)
-	if _, err := os.Stat(vendorPath); err == nil {
-		return vendorPath, false, checkPrecompiledCache(tmpBuildDir, importPath, vendorPath)
+	vendored := vendorModulesForDir(buildModDir, srcs)
+	if vendored != nil { // Only the packages listed in vendor/modules.txt
+		if vendorPath := vendored.findDirForImport(importPath); vendorPath != "" {
+			return vendorPath, false, "", nil
+		}
+	} else {
+		vendorPath := filepath.Join(buildModDir, "vendor", importPath)
+		if _, err := srcs.stat(vendorPath); err == nil {
+			return vendorPath, false, "", nil
+		}
 	}
-	// Check gopath directory.
-	gopathPath := filepath.Join(goPath, importPath)
-	if _, err := os.Stat(gopathPath); err == nil {
-		return gopathPath, false, checkPrecompiledCache(tmpBuildDir, importPath, gopathPath)
+	// Check the required modules (in the module cache or local proxies), unless they are vendored
+	if buildList := loadModuleBuildList(buildDir, srcs, ctx); buildList != nil && vendored == nil {
+		moduleDir, err := buildList.findDirForImport(importPath, srcs, ctx)
+		if moduleDir != "" || err != nil {
+			return moduleDir, false, "", err
+		}
 	}
-	// Fall back to checking the standard library (precompiled).
-	standardPkgPath := filepath.Join(goPkgPath(ctx), importPath+".a")
-	if _, err := os.Stat(standardPkgPath); err == nil {
-		return filepath.Join(goSrcPath(ctx), importPath), true, standardPkgPath
+	// Check the GOPATH entries (in GOPATH mode, imports are resolved by parseFindGopathDirForImport instead)
+	for _, srcDir := range gopathSrcDirs(goPath) {
+		gopathPath := filepath.Join(srcDir, filepath.FromSlash(importPath))
+		if _, err := srcs.stat(gopathPath); err == nil {
+			return gopathPath, false, "", nil
+		}
 	}
-	// Fall back to checking the standard library (vendor sources).
-	standardSrcVendorPath := filepath.Join(goSrcPath(ctx), "vendor", importPath)
-	if _, err := os.Stat(standardSrcVendorPath); err == nil {
-		return standardSrcVendorPath, true, checkPrecompiledCache(tmpBuildDir, importPath, standardSrcVendorPath)
+	// Fall back to checking the standard library
+	dirOrArchive, precompiledArchive = parseFindStdDirForImport(importPath, srcs, ctx)
+	return dirOrArchive, dirOrArchive != "", precompiledArchive, nil // An empty dirOrArchive means not found
+}
+
+// parseFindStdDirForImport finds an import in the standard library: a standard package, or a package vendored by the
+// standard library (see stdImportPath). The imports of standard packages are only resolved here.
+func parseFindStdDirForImport(importPath string, srcs *sources, ctx build.Context) (dir string, precompiledArchive string) {
+	for _, actualPath := range []string{importPath, "vendor/" + importPath} {
+		// Precompiled
+		standardPkgPath := filepath.Join(goPkgPath(ctx), filepath.FromSlash(actualPath)+".a")
+		if _, err := os.Stat(standardPkgPath); err == nil {
+			return filepath.Join(goSrcPath(ctx), filepath.FromSlash(actualPath)), standardPkgPath
+		}
+	}
+	for _, actualPath := range []string{"vendor/" + importPath, importPath} {
+		// Sources
+		standardSrcPath := filepath.Join(goSrcPath(ctx), filepath.FromSlash(actualPath))
+		if _, err := srcs.stat(standardSrcPath); err == nil {
+			return standardSrcPath, ""
+		}
 	}
-	// Fall back to checking the standard library (sources).
-	standardSrcPath := filepath.Join(goSrcPath(ctx), importPath)
-	if _, err := os.Stat(standardSrcPath); err == nil {
-		return standardSrcPath, true, checkPrecompiledCache(tmpBuildDir, importPath, standardSrcPath)
+	return "", ""
+}
+
+// stdImportPath returns the actual import path of a package of the standard library imported by importPath: like the
+// go command, the packages vendored by the standard library are compiled as vendor/<import path>, so that they never
+// clash with the same packages required by the user (the importers map the paths with importmap lines, see
+// compileImportCfg). Other packages keep their import path (also those vendored by modules, like the go command).
+func stdImportPath(importPath, importDir string, ctx build.Context) string {
+	if strings.HasPrefix(importDir, filepath.Join(goSrcPath(ctx), "vendor")+string(filepath.Separator)) {
+		return "vendor/" + importPath
 	}
-	// An empty dirOrArchive means not found
-	return "", false, ""
+	return importPath
 }
 
-func findAndParseGoMod(dirOrFile string) (baseDir string, modulePath string, replace map[string]string) {
+// findAndParseGoMod finds the go.mod file of the module of dirOrFile, and returns its directory, module path and replace
+// directives (with local replacement directories made absolute).
+func findAndParseGoMod(dirOrFile string, srcs *sources) (baseDir string, modulePath string, replaces []*modfile.Replace) {
 	dirOrFile, err := filepath.Abs(dirOrFile)
 	if err != nil {
 		return "", "", nil
 	}
-	stat, err := os.Stat(dirOrFile)
+	stat, err := srcs.stat(dirOrFile)
 	if err != nil {
 		return "", "", nil
 	}
 	if stat.IsDir() {
 		dir := dirOrFile
 		possibleGoModFile := filepath.Join(dir, "go.mod")
-		openGoMod, err := os.Open(possibleGoModFile)
-		if err == nil {
-			all, err := ioutil.ReadAll(openGoMod)
-			if err == nil {
-				// Handle go.mod replace directives
-				lax, err := modfile.ParseLax(possibleGoModFile, all, nil)
-				if err == nil {
-					replaces := map[string]string{}
-					for _, r := range lax.Replace {
-						replaces[r.Old.Path] = r.New.Path
-					}
-					return dir, lax.Module.Mod.Path, replaces // Found and parsed go.mod file
-				} else {
-					log.Println("Error parsing go.mod file:", err)
+		if _, err = srcs.stat(possibleGoModFile); err == nil {
+			goMod, err := parseMainGoModFile(possibleGoModFile, srcs)
+			if err == nil && goMod.Module != nil {
+				for _, r := range goMod.Replace {
+					replaces = append(replaces, absReplace(r, dir))
 				}
+				return dir, goMod.Module.Mod.Path, replaces // Found and parsed go.mod file
+			} else if err != nil {
+				log.Println("Error parsing go.mod file:", err)
 			} else {
-				log.Println("Error reading go.mod file:", err)
+				log.Println("Error parsing go.mod file: missing module directive in", possibleGoModFile)
 			}
 		} // Not found, keep searching
 	}
 	parentDir := filepath.Dir(dirOrFile)
 	if parentDir != dirOrFile { // Recurse
-		return findAndParseGoMod(parentDir)
+		return findAndParseGoMod(parentDir, srcs)
 	}
 	return "", "", nil // Not found
 }
 
-func checkPrecompiledCache(buildDir string, importPath string, sourcesPath string) string {
-	cacheFile := pkgArchiveCacheFor(importPath, buildDir)
-	stat, err := os.Stat(cacheFile)
-	if err != nil { // Precompiled file not found (not yet built)
-		return ""
+// absReplace returns the replace directive with its replacement directory (if it is a local one) made absolute, as it
+// is relative to the directory of the go.mod or go.work file that declares it.
+func absReplace(r *modfile.Replace, dir string) *modfile.Replace {
+	if !modfile.IsDirectoryPath(r.New.Path) || filepath.IsAbs(r.New.Path) {
+		return r
 	}
-	// Now, check that all files in sourcesPath are older than the latest built file
-	cacheDate := stat.ModTime()
-	dir, err := os.Open(sourcesPath)
-	if err != nil {
+	abs := *r
+	abs.New.Path = filepath.Join(dir, filepath.FromSlash(r.New.Path))
+	return &abs
+}
+
+// findReplacement returns the replacement of the given module version: a module version, or a local directory
+// (absolute, with an empty version). Replacements of a specific version take precedence over those of all versions.
+func findReplacement(replaces []*modfile.Replace, m module.Version) (module.Version, bool) {
+	for _, r := range replaces {
+		if r.Old.Path == m.Path && r.Old.Version != "" && r.Old.Version == m.Version {
+			return r.New, true
+		}
+	}
+	for _, r := range replaces {
+		if r.Old.Path == m.Path && r.Old.Version == "" {
+			return r.New, true
+		}
+	}
+	return m, false
+}
+
+// findPackageInModule returns the directory of importPath inside the module with the given path and root directory,
+// or "" if it does not exist or belongs to a nested module (a subdirectory with its own go.mod file).
+func findPackageInModule(importPath, modulePath, moduleDir string, srcs *sources) string {
+	if importPath != modulePath && !strings.HasPrefix(importPath, modulePath+"/") {
 		return ""
 	}
-	dirEntries, err := dir.Readdir(-1)
-	if err != nil {
+	dir := filepath.Join(moduleDir, filepath.FromSlash(importPath[len(modulePath):]))
+	if stat, err := srcs.stat(dir); err != nil || !stat.IsDir() {
 		return ""
 	}
-	for _, entry := range dirEntries {
-		if entry.ModTime().After(cacheDate) {
-			return "" // Cache is invalid for this file (source modified)
+	for subDir := dir; len(subDir) > len(moduleDir); subDir = filepath.Dir(subDir) {
+		if _, err := srcs.stat(filepath.Join(subDir, "go.mod")); err == nil {
+			return "" // Part of a nested module
 		}
 	}
-	return cacheFile
+	return dir
 }
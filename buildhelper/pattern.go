@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A package pattern selects several packages to build at once, like the go command: "std" (the standard library), or
+// a directory path with "..." wildcards (e.g. ./... or ./cmd/...), that match any string, so that x/... also matches x.
+// The directories named testdata or starting with . or _ are never matched, nor the vendor directories and nested
+// modules (with their own go.mod file) of path patterns.
+
+// isPackagePattern reports whether the input is a package pattern instead of a package directory or file.
+func isPackagePattern(input string) bool {
+	return input == "std" || strings.Contains(input, "...")
+}
+
+// patternRootDir returns the directory where the matches of a path pattern are searched.
+func patternRootDir(pattern string) (string, error) {
+	root := pattern[:strings.Index(pattern, "...")]
+	if !strings.HasSuffix(root, "/") && !strings.HasSuffix(root, string(filepath.Separator)) {
+		root = filepath.Dir(root) // e.g. ./cmd/tool... searches ./cmd
+	}
+	return filepath.Abs(root)
+}
+
+// patternMatch is a package matched by a pattern.
+type patternMatch struct {
+	dir, importPath string // "main" for main packages
+}
+
+// parsePattern parses all packages matched by a pattern (see isPackagePattern), returning them in the order of their
+// directories. Their dependencies are parsed once, so each package is only compiled once (see compilePackages).
+func parsePattern(pattern string, srcs *sources, buildCtx build.Context) ([]*parsedTreeNode, bool, error) {
+	fset := token.NewFileSet()
+	buildCtx = srcs.buildContext(buildCtx)
+	std := pattern == "std"
+	matches, err := matchPackages(fset, pattern, srcs, buildCtx)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(matches) == 0 {
+		return nil, false, errors.New("pattern " + pattern + " matched no packages")
+	}
+	precompiledInternal := hasPrecompiledStd(buildCtx)
+	explored := map[string]*parsedTreeNode{}
+	var roots []*parsedTreeNode
+	for _, m := range matches {
+		if node, ok := explored[m.dir]; ok { // Already imported by a previous package
+			roots = append(roots, node)
+			continue
+		}
+		if !std {
+			if _, err = findAndParseGoWork(m.dir, srcs); err != nil {
+				return nil, false, err
+			}
+			if err = checkVendorConsistency(m.dir, srcs); err != nil {
+				return nil, false, err
+			}
+		}
+		node, err := parseRecursive(fset, m.dir, m.importPath, m.dir, srcs, buildCtx, std, precompiledInternal, noTestFiles, explored)
+		if err != nil {
+			return nil, false, err
+		}
+		if m.importPath == "main" {
+			node.planName = importPathForDir(m.dir, srcs, buildCtx)
+		}
+		if std && precompiledInternal && !stdPackageStale(m.importPath, srcs, buildCtx) {
+			node.validPrecompiledArchivePath = filepath.Join(goPkgPath(buildCtx), filepath.FromSlash(m.importPath)+".a")
+		}
+		if err = checkCgo(node, srcs, buildCtx); err != nil {
+			return nil, false, err
+		}
+		roots = append(roots, node)
+	}
+	return roots, precompiledInternal, nil
+}
+
+// matchPackages returns the packages matched by a pattern: the directories with Go files for the target.
+func matchPackages(fset *token.FileSet, pattern string, srcs *sources, buildCtx build.Context) ([]patternMatch, error) {
+	std := pattern == "std"
+	var root string
+	var match *regexp.Regexp
+	var err error
+	if std {
+		root = goSrcPath(buildCtx)
+	} else {
+		if root, err = patternRootDir(pattern); err != nil {
+			return nil, err
+		}
+		absPattern, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		match = patternRegexp(filepath.ToSlash(absPattern))
+	}
+	rootInfo, err := srcs.stat(root) // The root may be a symbolic link (e.g. $GOROOT/src)
+	if err != nil {
+		return nil, err
+	}
+	var matches []patternMatch
+	err = srcs.walkRecursive(root, rootInfo, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if dir != root {
+			name := info.Name()
+			if name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if std && dir == filepath.Join(root, "cmd") {
+				return filepath.SkipDir // Not part of std (and a module of its own)
+			}
+			if !std && name == "vendor" {
+				return filepath.SkipDir
+			}
+			if _, err := srcs.stat(filepath.Join(dir, "go.mod")); !std && err == nil {
+				return filepath.SkipDir // Nested module
+			}
+		}
+		if match != nil && !match.MatchString(filepath.ToSlash(dir)) {
+			return nil
+		}
+		pkgName, err := packageNameForDir(fset, dir, srcs, buildCtx)
+		if err != nil || pkgName == "" {
+			return err
+		}
+		importPath := "main"
+		if std {
+			importPath = filepath.ToSlash(dir[len(root)+1:])
+			if importPath == "builtin" || importPath == "unsafe" {
+				return nil // Documentation, and built into the compiler
+			}
+		} else if pkgName != "main" {
+			importPath = importPathForDir(dir, srcs, buildCtx)
+		}
+		matches = append(matches, patternMatch{dir: dir, importPath: importPath})
+		return nil
+	})
+	if err == filepath.SkipDir {
+		err = nil
+	}
+	return matches, err
+}
+
+// patternRegexp returns the regular expression of a pattern (in slash form): ... matches any string, and x/... also
+// matches x.
+func patternRegexp(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	if strings.HasSuffix(re, `/.*`) {
+		re = re[:len(re)-len(`/.*`)] + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`)
+}
+
+// packageNameForDir returns the package name of the Go files of dir that are built for the target (except tests), or
+// "" if there are none.
+func packageNameForDir(fset *token.FileSet, dir string, srcs *sources, buildCtx build.Context) (string, error) {
+	entries, err := srcs.readDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := buildCtx.MatchFile(dir, name); !ok || err != nil {
+			continue
+		}
+		file, err := srcs.parseFile(fset, filepath.Join(dir, name), parser.ImportsOnly)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", dir, err)
+		}
+		if cgoPos := cgoImportPos(fset, file); cgoPos.IsValid() && !buildCtx.CgoEnabled {
+			continue
+		}
+		return file.Name.Name, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,29 @@
+package main
+
+// action is a single low-level tool invocation of the build plan.
+// Actions only depend on the outputs of the actions listed in Deps, so any actions whose dependencies have already
+// finished may run concurrently (e.g. in several wasm instances or workers).
+type action struct {
+	ID      string   `json:"id"`
+	Deps    []string `json:"deps"`
+	Inputs  []string `json:"inputs"`
+	Outputs []string `json:"outputs"`
+	Command []string `json:"command"`
+	// Package is the import path of the package that the action builds (none for the link action), for diagnostics
+	Package string `json:"package,omitempty"`
+	// Env are the environment settings (KEY=value) that the tool must run with, on top of the environment of the build
+	Env []string `json:"env,omitempty"`
+}
+
+func newAction(id string, deps []string, inputs []string, outputs []string, command []string) *action {
+	if deps == nil {
+		deps = []string{} // Always serialize as a list
+	}
+	return &action{
+		ID:      id,
+		Deps:    deps,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Command: command,
+	}
+}
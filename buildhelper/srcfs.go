@@ -0,0 +1,423 @@
+package main
+
+import (
+	"archive/zip"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sourceFS is a read-only file system that sources may be loaded from instead of the OS, like a zip archive. Names are
+// slash-separated paths relative to its root ("." for the root), as in io/fs (see srcfs_iofs.go to use any io/fs.FS).
+type sourceFS interface {
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// sourceMount is a sourceFS that provides the contents of an (absolute) directory.
+type sourceMount struct {
+	dir  string
+	fsys sourceFS
+}
+
+// sources are the source files of a build (or of the language server): the overlaid files take precedence over the
+// mounted file systems, that take precedence over the OS for their directories. Everything else (like GOROOT or the
+// module cache) is loaded from the OS. Each Run has its own, so nothing is shared between builds.
+type sources struct {
+	mounts []sourceMount // longest directory first, for nested mounts
+	// overlay maps the absolute paths of the overlaid source files to the absolute paths of the files with their
+	// contents ("" for deleted files)
+	overlay map[string]string
+	// overlayCopies maps the copies of overlaid Go files that the compiler reads to the overlaid files
+	overlayCopies map[string]string
+	// overlayDirs maps the directories (and their parents) of the overlaid files to the names of their overlaid entries
+	overlayDirs map[string]map[string]bool
+	// instrumentationFile is the path of the generated file of the main package ("" if it is not instrumented). It is
+	// overlaid in the directory of the main package, so that it is also added to a main package given as a file.
+	instrumentationFile string
+	// moreInputFiles are the other .go files of the main package when the input is a list of files (like go run a.go
+	// b.go), after the first one.
+	moreInputFiles []string
+
+	// The files parsed through the sources are memoized until overlays change (see resetMemos)
+	goWorkspaces     map[string]*workspace                   // by go.work file
+	moduleBuildLists map[string]*moduleBuildList             // by directory of the main go.mod or go.work file
+	vendorModules    map[string]*vendorModules               // by main module directory (nil without modules.txt)
+	stdManifests     map[string]map[string]*stdManifestEntry // by manifest path (nil if there is none)
+	stdStale         map[string]bool                         // by archive path of the precompiled packages
+	// toolchainVersions memoizes the version of the toolchain at each GOROOT, which overlays never change
+	toolchainVersions map[string]string
+}
+
+// newSources returns sources loaded from the OS, until file systems are mounted or files are overlaid.
+func newSources() *sources {
+	srcs := &sources{
+		overlay:           map[string]string{},
+		overlayCopies:     map[string]string{},
+		overlayDirs:       map[string]map[string]bool{},
+		stdManifests:      map[string]map[string]*stdManifestEntry{},
+		toolchainVersions: map[string]string{},
+	}
+	srcs.resetMemos()
+	return srcs
+}
+
+// resetMemos forgets everything parsed from the sources, as overlaid files may change it. The manifest of the
+// precompiled standard library is only written by -std, so it is kept.
+func (srcs *sources) resetMemos() {
+	srcs.goWorkspaces = map[string]*workspace{}
+	srcs.moduleBuildLists = map[string]*moduleBuildList{}
+	srcs.vendorModules = map[string]*vendorModules{}
+	srcs.stdStale = map[string]bool{}
+}
+
+// mount makes the given file system provide the contents of dir.
+func (srcs *sources) mount(dir string, fsys sourceFS) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	srcs.mounts = append(srcs.mounts, sourceMount{dir: dir, fsys: fsys})
+	sort.SliceStable(srcs.mounts, func(i, j int) bool { return len(srcs.mounts[i].dir) > len(srcs.mounts[j].dir) })
+	return nil
+}
+
+// resolve returns the mounted file system that provides the given absolute path and the name of the path in it, or a
+// nil file system if it is loaded from the OS.
+func (srcs *sources) resolve(p string) (sourceFS, string) {
+	p = filepath.Clean(p)
+	for _, m := range srcs.mounts {
+		if p == m.dir {
+			return m.fsys, "."
+		}
+		if strings.HasPrefix(p, m.dir+string(filepath.Separator)) {
+			return m.fsys, filepath.ToSlash(p[len(m.dir)+1:])
+		}
+	}
+	return nil, ""
+}
+
+func (srcs *sources) stat(p string) (os.FileInfo, error) {
+	if info, ok, err := srcs.overlayStat(p); ok {
+		return info, err
+	}
+	info, err := srcs.statMountedOrOS(p, os.Stat)
+	if os.IsNotExist(err) && srcs.overlayDirs[filepath.Clean(p)] != nil {
+		return sourceDirInfo(filepath.Base(p)), nil // Only contains overlaid files
+	}
+	return info, err
+}
+
+// lstat is like stat, but it does not follow symbolic links (mounted file systems have none).
+func (srcs *sources) lstat(p string) (os.FileInfo, error) {
+	if info, ok, err := srcs.overlayStat(p); ok {
+		return info, err
+	}
+	info, err := srcs.statMountedOrOS(p, os.Lstat)
+	if os.IsNotExist(err) && srcs.overlayDirs[filepath.Clean(p)] != nil {
+		return sourceDirInfo(filepath.Base(p)), nil
+	}
+	return info, err
+}
+
+func (srcs *sources) statMountedOrOS(p string, osStat func(string) (os.FileInfo, error)) (os.FileInfo, error) {
+	if fsys, name := srcs.resolve(p); fsys != nil {
+		return fsys.Stat(name)
+	}
+	return osStat(p)
+}
+
+func (srcs *sources) open(p string) (io.ReadCloser, error) {
+	if replacement, ok := srcs.overlay[filepath.Clean(p)]; ok {
+		if replacement == "" {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		return os.Open(replacement)
+	}
+	if fsys, name := srcs.resolve(p); fsys != nil {
+		return fsys.Open(name)
+	}
+	return os.Open(p)
+}
+
+func (srcs *sources) readFile(p string) ([]byte, error) {
+	f, err := srcs.open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// readDir returns the entries of the given directory, sorted by name.
+func (srcs *sources) readDir(dir string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	var err error
+	if fsys, name := srcs.resolve(dir); fsys != nil {
+		entries, err = fsys.ReadDir(name)
+	} else {
+		entries, err = ioutil.ReadDir(dir)
+	}
+	return srcs.overlayReadDir(dir, entries, err)
+}
+
+// walk is like filepath.Walk, for sources that may be mounted.
+func (srcs *sources) walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := srcs.lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = srcs.walkRecursive(root, info, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (srcs *sources) walkRecursive(p string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(p, info, nil)
+	}
+	entries, err := srcs.readDir(p)
+	walkErr := walkFn(p, info, err)
+	if err != nil || walkErr != nil {
+		return walkErr
+	}
+	for _, entry := range entries {
+		err = srcs.walkRecursive(filepath.Join(p, entry.Name()), entry, walkFn)
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// glob is like filepath.Glob, for sources that may be mounted.
+func (srcs *sources) glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasGlobMeta(pattern) {
+		if _, err := srcs.lstat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	dir, file := filepath.Split(pattern)
+	if dir == "" {
+		dir = "."
+	} else if len(dir) > 1 {
+		dir = dir[:len(dir)-1] // Without the trailing separator
+	}
+	if !hasGlobMeta(dir) {
+		return srcs.globDir(dir, file, nil)
+	}
+	if dir == pattern {
+		return nil, filepath.ErrBadPattern
+	}
+	dirMatches, err := srcs.glob(dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, dirMatch := range dirMatches {
+		if matches, err = srcs.globDir(dirMatch, file, matches); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// globDir appends the entries of dir that match the pattern to matches.
+func (srcs *sources) globDir(dir, pattern string, matches []string) ([]string, error) {
+	if info, err := srcs.stat(dir); err != nil || !info.IsDir() {
+		return matches, nil
+	}
+	entries, err := srcs.readDir(dir)
+	if err != nil {
+		return matches, nil
+	}
+	for _, entry := range entries {
+		if matched, err := filepath.Match(pattern, entry.Name()); err != nil {
+			return matches, err
+		} else if matched {
+			matches = append(matches, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return matches, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	magicChars := `*?[`
+	if filepath.Separator != '\\' {
+		magicChars = `*?[\`
+	}
+	return strings.ContainsAny(pattern, magicChars)
+}
+
+// parseFile is like parser.ParseFile, for a source file that may be mounted.
+func (srcs *sources) parseFile(fset *token.FileSet, filePath string, mode parser.Mode) (*ast.File, error) {
+	src, err := srcs.readFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseFile(fset, filePath, src, mode)
+}
+
+// parseDir is like parser.ParseDir (without filter), for a source directory that may be mounted.
+func (srcs *sources) parseDir(fset *token.FileSet, dir string, mode parser.Mode) (map[string]*ast.Package, error) {
+	entries, err := srcs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := map[string]*ast.Package{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".go") {
+			continue
+		}
+		filePath := filepath.Join(dir, entry.Name())
+		file, err := srcs.parseFile(fset, filePath, mode)
+		if err != nil {
+			return nil, err
+		}
+		pkg, ok := pkgs[file.Name.Name]
+		if !ok {
+			pkg = &ast.Package{Name: file.Name.Name, Files: map[string]*ast.File{}}
+			pkgs[file.Name.Name] = pkg
+		}
+		pkg.Files[filePath] = file
+	}
+	return pkgs, nil
+}
+
+// buildContext makes go/build load files through the mounted file systems (e.g. to match build constraints).
+func (srcs *sources) buildContext(buildCtx build.Context) build.Context {
+	buildCtx.OpenFile = srcs.open
+	buildCtx.ReadDir = srcs.readDir
+	buildCtx.IsDir = func(p string) bool {
+		info, err := srcs.stat(p)
+		return err == nil && info.IsDir()
+	}
+	return buildCtx
+}
+
+// extractMountedInputs writes the inputs of the actions that are provided by a mounted file system to their paths, as
+// the tools only read files from the OS. Nothing else of the mounted file systems is extracted.
+func (srcs *sources) extractMountedInputs(actions []*action) error {
+	extracted := map[string]bool{}
+	for _, a := range actions {
+		for _, input := range a.Inputs {
+			fsys, name := srcs.resolve(input)
+			if fsys == nil || extracted[input] {
+				continue
+			}
+			extracted[input] = true
+			contents, err := srcs.readFile(input)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(input), 0755); err != nil {
+				return err
+			}
+			if err = ioutil.WriteFile(input, contents, 0644); err != nil {
+				return err
+			}
+			log.Println("Extracted", name, "to", input)
+		}
+	}
+	return nil
+}
+
+// zipFS is a sourceFS with the contents of a zip archive.
+type zipFS struct {
+	files map[string]*zip.File
+	dirs  map[string][]os.FileInfo // Entries of each directory (including implicit ones), sorted by name
+}
+
+// openZipFS opens the given zip archive as a sourceFS (it is never closed, as sources are read until the end).
+func openZipFS(archive string) (*zipFS, error) {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	return newZipFS(&r.Reader), nil
+}
+
+func newZipFS(r *zip.Reader) *zipFS {
+	z := &zipFS{files: map[string]*zip.File{}, dirs: map[string][]os.FileInfo{".": nil}}
+	var addDir func(name string)
+	addDir = func(name string) {
+		if _, ok := z.dirs[name]; ok {
+			return
+		}
+		z.dirs[name] = nil
+		parent := path.Dir(name)
+		addDir(parent)
+		z.dirs[parent] = append(z.dirs[parent], sourceDirInfo(path.Base(name)))
+	}
+	for _, f := range r.File {
+		name := path.Clean(strings.TrimPrefix(f.Name, "/"))
+		if strings.HasSuffix(f.Name, "/") {
+			addDir(name)
+			continue
+		}
+		if _, ok := z.files[name]; ok {
+			continue // Duplicate entry: keep the first one
+		}
+		z.files[name] = f
+		addDir(path.Dir(name))
+		z.dirs[path.Dir(name)] = append(z.dirs[path.Dir(name)], f.FileInfo())
+	}
+	for _, entries := range z.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return z
+}
+
+func (z *zipFS) Open(name string) (io.ReadCloser, error) {
+	f, ok := z.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return f.Open()
+}
+
+func (z *zipFS) Stat(name string) (os.FileInfo, error) {
+	if f, ok := z.files[name]; ok {
+		return f.FileInfo(), nil
+	}
+	if _, ok := z.dirs[name]; ok {
+		return sourceDirInfo(path.Base(name)), nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (z *zipFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, ok := z.dirs[name]
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]os.FileInfo{}, entries...), nil
+}
+
+// sourceDirInfo describes a directory without its own entry (in a zip archive or only made of overlaid files).
+type sourceDirInfo string
+
+func (d sourceDirInfo) Name() string       { return string(d) }
+func (d sourceDirInfo) Size() int64        { return 0 }
+func (d sourceDirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d sourceDirInfo) ModTime() time.Time { return time.Time{} }
+func (d sourceDirInfo) IsDir() bool        { return true }
+func (d sourceDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,44 @@
+//go:build go1.16
+// +build go1.16
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ioFS adapts an io/fs.FS (like an embed.FS, a zip.Reader or a testing/fstest.MapFS) to a sourceFS.
+type ioFS struct {
+	fsys fs.FS
+}
+
+// mountIOFS makes the given io/fs file system provide the contents of dir.
+func (srcs *sources) mountIOFS(dir string, fsys fs.FS) error {
+	return srcs.mount(dir, ioFS{fsys: fsys})
+}
+
+func (f ioFS) Open(name string) (io.ReadCloser, error) {
+	return f.fsys.Open(name)
+}
+
+func (f ioFS) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(f.fsys, name)
+}
+
+func (f ioFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
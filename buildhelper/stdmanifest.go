@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The precompiled standard library may ship with a manifest of the sources it was compiled from (see writeStdManifest),
+// so that the standard library stays editable: a precompiled package is stale if the hash of its sources changed, or if
+// any of its dependencies is stale. Stale packages are parsed and compiled from sources (into the cache, like the
+// packages of the user), while the precompiled archives of all other packages are still used. Without a manifest,
+// precompiled packages are never stale.
+
+// stdManifestName is the name of the manifest file in the directory of the precompiled standard library.
+const stdManifestName = "sources.manifest"
+
+// stdManifestEntry is the line of a precompiled package in the manifest: "<import path> <sources hash> <imports...>".
+type stdManifestEntry struct {
+	hash    string
+	imports []string // actual import paths (e.g. vendor/golang.org/x/net/dns/dnsmessage)
+}
+
+// stdSourcesHash returns the hash of the source files of the standard package at dir (all .go, .s and .h files but
+// tests, whatever their build constraints are), so that any edit, addition or deletion changes it.
+func stdSourcesHash(dir string, srcs *sources) (string, error) {
+	entries, err := srcs.readDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext == ".go" || ext == ".s" || ext == ".h" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := &actionIDHash{h: sha256.New()}
+	for _, name := range names {
+		if err = h.addFile(name, filepath.Join(dir, name), srcs); err != nil {
+			return "", err
+		}
+	}
+	return h.sum(), nil
+}
+
+// writeStdManifest writes the manifest of the precompiled standard library of the target, with the hash of the sources
+// and the imports of each precompiled package. It must run when the standard library is precompiled.
+func writeStdManifest(srcs *sources, buildCtx build.Context) error {
+	buildCtx = srcs.buildContext(buildCtx)
+	pkgPath := goPkgPath(buildCtx)
+	var lines []string
+	err := filepath.Walk(pkgPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".a") {
+			return err
+		}
+		importPath := filepath.ToSlash(strings.TrimSuffix(path[len(pkgPath)+1:], ".a"))
+		dir := filepath.Join(goSrcPath(buildCtx), filepath.FromSlash(importPath))
+		hash, err := stdSourcesHash(dir, srcs)
+		if err != nil {
+			return err
+		}
+		pkg, err := buildCtx.ImportDir(dir, 0)
+		if _, ok := err.(*build.NoGoError); ok {
+			log.Println("Skipping", importPath, "in the manifest (precompiled with other build settings):", err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", importPath, err)
+		}
+		fields := []string{importPath, hash}
+		for _, imp := range pkg.Imports {
+			if imp == "unsafe" || imp == "C" {
+				continue
+			}
+			impDir, _ := parseFindStdDirForImport(imp, srcs, buildCtx)
+			if impDir == "" {
+				return fmt.Errorf("%s: import %q not found in the standard library", importPath, imp)
+			}
+			fields = append(fields, stdImportPath(imp, impDir, buildCtx))
+		}
+		lines = append(lines, strings.Join(fields, " ")+"\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(pkgPath, stdManifestName)
+	log.Println("Writing the manifest of", len(lines), "precompiled packages to", manifestPath)
+	return ioutil.WriteFile(manifestPath, []byte(strings.Join(lines, "")), 0644)
+}
+
+// loadStdManifest returns the manifest of the precompiled standard library of the target, by import path (nil if
+// there is none).
+func loadStdManifest(srcs *sources, buildCtx build.Context) map[string]*stdManifestEntry {
+	manifestPath := filepath.Join(goPkgPath(buildCtx), stdManifestName)
+	if manifest, ok := srcs.stdManifests[manifestPath]; ok {
+		return manifest
+	}
+	var manifest map[string]*stdManifestEntry
+	if f, err := os.Open(manifestPath); err == nil {
+		manifest = map[string]*stdManifestEntry{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) >= 2 {
+				manifest[fields[0]] = &stdManifestEntry{hash: fields[1], imports: fields[2:]}
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			log.Println("Error reading the manifest of the standard library:", err)
+			manifest = nil
+		}
+		_ = f.Close()
+	}
+	srcs.stdManifests[manifestPath] = manifest
+	return manifest
+}
+
+// stdPackageStale reports whether the precompiled package of the standard library with the given (actual) import path
+// is stale: its sources changed since it was precompiled, or it imports a stale package (see loadStdManifest).
+func stdPackageStale(importPath string, srcs *sources, buildCtx build.Context) bool {
+	archive := filepath.Join(goPkgPath(buildCtx), filepath.FromSlash(importPath)+".a")
+	if stale, ok := srcs.stdStale[archive]; ok {
+		return stale
+	}
+	stale := false
+	if entry := loadStdManifest(srcs, buildCtx)[importPath]; entry != nil {
+		hash, err := stdSourcesHash(filepath.Join(goSrcPath(buildCtx), filepath.FromSlash(importPath)), srcs)
+		if stale = err != nil || hash != entry.hash; stale {
+			log.Println("The sources of", importPath, "changed, compiling it (and its importers) from sources")
+		}
+		for i := 0; i < len(entry.imports) && !stale; i++ {
+			stale = stdPackageStale(entry.imports[i], srcs, buildCtx)
+		}
+	}
+	srcs.stdStale[archive] = stale
+	return stale
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// subArchVariable describes the environment variable that selects the variant of a target architecture (see
+// internal/buildcfg of GOROOT).
+type subArchVariable struct {
+	name         string
+	defaultValue string
+	validValues  []string // Allowed values (before any comma-separated options)
+	validOptions []string // Allowed comma-separated options
+}
+
+// goarm64Versions are the architecture versions of GOARM64, in order.
+var goarm64Versions = []string{"v8.0", "v8.1", "v8.2", "v8.3", "v8.4", "v8.5", "v8.6", "v8.7", "v8.8", "v8.9", "v9.0", "v9.1",
+	"v9.2", "v9.3", "v9.4", "v9.5"}
+
+// subArchVariables maps each GOARCH with variants to its variable.
+var subArchVariables = map[string]subArchVariable{
+	"386":      {"GO386", "sse2", []string{"sse2", "softfloat", "387"}, nil},
+	"amd64":    {"GOAMD64", "v1", []string{"v1", "v2", "v3", "v4"}, nil},
+	"arm":      {"GOARM", "7", []string{"5", "6", "7"}, []string{"softfloat", "hardfloat"}},
+	"arm64":    {"GOARM64", "v8.0", goarm64Versions, []string{"lse", "crypto"}},
+	"mips":     {"GOMIPS", "hardfloat", []string{"hardfloat", "softfloat"}, nil},
+	"mipsle":   {"GOMIPS", "hardfloat", []string{"hardfloat", "softfloat"}, nil},
+	"mips64":   {"GOMIPS64", "hardfloat", []string{"hardfloat", "softfloat"}, nil},
+	"mips64le": {"GOMIPS64", "hardfloat", []string{"hardfloat", "softfloat"}, nil},
+	"ppc64":    {"GOPPC64", "power8", []string{"power8", "power9", "power10"}, nil},
+	"ppc64le":  {"GOPPC64", "power8", []string{"power8", "power9", "power10"}, nil},
+	"riscv64":  {"GORISCV64", "rva20u64", []string{"rva20u64", "rva22u64", "rva23u64"}, nil},
+	"wasm":     {"GOWASM", "", []string{""}, []string{"satconv", "signext"}},
+}
+
+// subArchValue returns the variable and its value (from the environment, or the default) selecting the variant of the
+// target architecture. The variable name is "" if the architecture has no variants.
+func subArchValue(buildCtx build.Context) (subArchVariable, string) {
+	v, ok := subArchVariables[buildCtx.GOARCH]
+	if !ok {
+		return subArchVariable{}, ""
+	}
+	if value := os.Getenv(v.name); value != "" {
+		return v, value
+	}
+	return v, v.defaultValue
+}
+
+// subArchSettings returns the environment settings that select the target variant (e.g. GOAMD64=v3 and GOEXPERIMENT),
+// that every tool of the build must run with.
+func subArchSettings(buildCtx build.Context) []string {
+	var settings []string
+	if v, value := subArchValue(buildCtx); v.name != "" {
+		settings = append(settings, v.name+"="+value)
+	}
+	if experiments := os.Getenv("GOEXPERIMENT"); experiments != "" {
+		settings = append(settings, "GOEXPERIMENT="+experiments)
+	}
+	return settings
+}
+
+// checkSubArch fails for invalid target variant settings, like the go command.
+func checkSubArch(buildCtx build.Context) error {
+	if v, value := subArchValue(buildCtx); v.name != "" {
+		parts := strings.Split(value, ",")
+		if v.name == "GOWASM" { // Only options
+			parts = append([]string{""}, parts...)
+		}
+		if indexOf(v.validValues, parts[0]) < 0 {
+			return fmt.Errorf("invalid %s=%s: must be one of %s", v.name, value, strings.Join(v.validValues, ", "))
+		}
+		for _, option := range parts[1:] {
+			if option != "" && indexOf(v.validOptions, option) < 0 {
+				return fmt.Errorf("invalid %s=%s: unknown option %q", v.name, value, option)
+			}
+		}
+	}
+	if experiments := os.Getenv("GOEXPERIMENT"); experiments != "" {
+		return checkExperiments(experiments, buildCtx)
+	}
+	return nil
+}
+
+// subArchTags returns the build tags of the target variant and of the enabled experiments (e.g. amd64.v1, amd64.v2 for
+// GOAMD64=v2, and goexperiment.arenas for GOEXPERIMENT=arenas), which may select files.
+func subArchTags(buildCtx build.Context) []string {
+	goarch := buildCtx.GOARCH
+	v, value := subArchValue(buildCtx)
+	parts := strings.Split(value, ",")
+	var tags []string
+	switch v.name {
+	case "GO386", "GOMIPS", "GOMIPS64":
+		tags = append(tags, goarch+"."+parts[0])
+	case "GOAMD64", "GOARM", "GOPPC64", "GORISCV64":
+		// Each level includes the previous ones
+		for _, level := range v.validValues[:indexOf(v.validValues, parts[0])+1] {
+			tags = append(tags, goarch+"."+level)
+		}
+	case "GOARM64":
+		level := indexOf(v.validValues, parts[0])
+		for _, version := range v.validValues[:level+1] {
+			if version[:2] == parts[0][:2] {
+				tags = append(tags, goarch+"."+version)
+			}
+		}
+		if strings.HasPrefix(parts[0], "v9.") { // v9.x includes v8.(x+5), up to v8.9
+			v8Level := level - indexOf(v.validValues, "v9.0") + 5
+			if v8Level > indexOf(v.validValues, "v8.9") {
+				v8Level = indexOf(v.validValues, "v8.9")
+			}
+			for _, version := range v.validValues[:v8Level+1] {
+				tags = append(tags, goarch+"."+version)
+			}
+		}
+	case "GOWASM":
+		for _, option := range parts {
+			if option != "" {
+				tags = append(tags, goarch+"."+option)
+			}
+		}
+	}
+	for _, experiment := range strings.Split(os.Getenv("GOEXPERIMENT"), ",") {
+		if experiment != "" && experiment != "none" && !strings.HasPrefix(experiment, "no") {
+			tags = append(tags, "goexperiment."+experiment)
+		}
+	}
+	return tags
+}
+
+// subArchAsmDefines returns the asm flags that define the target variant, like the go command of the toolchain at
+// GOROOT (e.g. -D GOAMD64_v3).
+func subArchAsmDefines(srcs *sources, buildCtx build.Context) []string {
+	minor := srcs.toolchainMinorVersion(buildCtx)
+	v, value := subArchValue(buildCtx)
+	parts := strings.Split(value, ",")
+	var flags []string
+	switch v.name {
+	case "GO386", "GOMIPS", "GOMIPS64":
+		flags = append(flags, "-D", v.name+"_"+parts[0])
+	case "GOAMD64":
+		if minor >= 18 {
+			flags = append(flags, "-D", "GOAMD64_"+parts[0])
+		}
+	case "GOARM", "GOPPC64":
+		if (v.name == "GOARM" && minor >= 22) || (v.name == "GOPPC64" && minor >= 20) {
+			// Every level up to the selected one, from the highest
+			levels := v.validValues[:indexOf(v.validValues, parts[0])+1]
+			for i := len(levels) - 1; i >= 0; i-- {
+				flags = append(flags, "-D", v.name+"_"+levels[i])
+			}
+		}
+	case "GORISCV64":
+		if minor >= 23 {
+			flags = append(flags, "-D", "GORISCV64_"+parts[0])
+		}
+	case "GOARM64":
+		if minor >= 23 && (indexOf(parts, "lse") >= 0 || parts[0] >= "v8.1") {
+			flags = append(flags, "-D", "GOARM64_LSE")
+		}
+	}
+	return flags
+}
+
+// checkExperiments validates a GOEXPERIMENT list with the experiments known by the toolchain at GOROOT (the fields of
+// internal/goexperiment.Flags). The list is accepted as is if the standard library sources are not available.
+func checkExperiments(experiments string, buildCtx build.Context) error {
+	flagsPath := filepath.Join(goSrcPath(buildCtx), "internal", "goexperiment", "flags.go")
+	flagsFile, err := parser.ParseFile(token.NewFileSet(), flagsPath, nil, 0)
+	if err != nil {
+		return nil
+	}
+	known := map[string]bool{"none": true, "regabi": true}
+	ast.Inspect(flagsFile, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok || spec.Name.Name != "Flags" {
+			return true
+		}
+		if structType, ok := spec.Type.(*ast.StructType); ok {
+			for _, field := range structType.Fields.List {
+				for _, name := range field.Names {
+					known[strings.ToLower(name.Name)] = true
+				}
+			}
+		}
+		return false
+	})
+	for _, experiment := range strings.Split(experiments, ",") {
+		if experiment == "" {
+			continue
+		}
+		if !known[strings.TrimPrefix(experiment, "no")] && !known[experiment] {
+			return fmt.Errorf("invalid GOEXPERIMENT=%s: unknown experiment %q (the toolchain at GOROOT is %s)",
+				experiments, experiment, readToolchainVersion(buildCtx))
+		}
+	}
+	return nil
+}
+
+// precompiledStdMatches reports whether the precompiled standard library at GOROOT was built for the target variant and
+// experiments, from the header of its runtime archive (e.g. "go object linux amd64 go1.21.0 GOAMD64=v1 X:regabiargs").
+// Archives without these details are assumed to be built with the defaults.
+func precompiledStdMatches(buildCtx build.Context) bool {
+	header := archiveHeader(filepath.Join(goPkgPath(buildCtx), "runtime.a"))
+	if len(header) < 5 {
+		return true // Unknown
+	}
+	builtVariant, builtExperiments := "", map[string]bool{}
+	for _, field := range header[5:] {
+		if strings.HasPrefix(field, "X:") {
+			for _, experiment := range strings.Split(field[len("X:"):], ",") {
+				builtExperiments[experiment] = true
+			}
+		} else if strings.Contains(field, "=") {
+			builtVariant = field
+		}
+	}
+	if v, value := subArchValue(buildCtx); v.name != "" {
+		if builtVariant == "" {
+			builtVariant = v.name + "=" + v.defaultValue
+		}
+		if builtVariant != v.name+"="+value {
+			return false
+		}
+	}
+	for _, experiment := range strings.Split(os.Getenv("GOEXPERIMENT"), ",") {
+		if experiment == "" || experiment == "none" {
+			continue
+		}
+		if strings.HasPrefix(experiment, "no") && builtExperiments[experiment[len("no"):]] {
+			return false
+		}
+		if !strings.HasPrefix(experiment, "no") && !builtExperiments[experiment] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// testFunc is a test, benchmark, fuzz target or example function of a test package.
+type testFunc struct {
+	Package   string // "_test" or "_xtest"
+	Name      string
+	Output    string // Examples only
+	Unordered bool   // Examples only
+}
+
+// testFuncs contains everything needed to generate the test main package.
+type testFuncs struct {
+	Tests       []testFunc
+	Benchmarks  []testFunc
+	FuzzTargets []testFunc
+	Examples    []testFunc
+	TestMain    *testFunc
+
+	ImportPath      string // of the package under test
+	XTestImportPath string // "" if there is no external test package
+	ImportTest      bool   // the test package is referenced
+	ImportXTest     bool   // the external test package is referenced
+
+	// Features depending on the toolchain version
+	MainStartFuzz         bool // testing.MainStart accepts fuzz targets (Go 1.18+)
+	TestMainExitCodeFromM bool // TestMain may return without calling os.Exit (Go 1.15+)
+	Test2JSON             bool // convert the verbose output to test2json events
+	SyncOnRunEnd          bool // with Test2JSON, the output is converted when m.Run ends, before TestMain exits (Go 1.16+)
+}
+
+// parseTest parses the package at pkgDir including its tests and generates a test main package (in buildDir) that runs
+// them. The returned tree is rooted at the test main package, which depends on the package under test compiled with its
+// internal _test.go files and the external test package (package <name>_test), if any.
+func parseTest(pkgDir, buildDir string, srcs *sources, buildCtx build.Context, test2JSON bool) (*parsedTreeNode, bool, error) {
+	fset := token.NewFileSet()
+	buildCtx = srcs.buildContext(buildCtx)
+	pkgDirAbs, err := filepath.Abs(pkgDir)
+	if err != nil {
+		return nil, false, err
+	}
+	if stat, err := srcs.stat(pkgDirAbs); err != nil {
+		return nil, false, err
+	} else if !stat.IsDir() {
+		return nil, false, errors.New("tests can only be built for package directories, not " + pkgDir)
+	}
+	if _, err = findAndParseGoWork(pkgDirAbs, srcs); err != nil {
+		return nil, false, err
+	}
+	if err = checkVendorConsistency(pkgDirAbs, srcs); err != nil {
+		return nil, false, err
+	}
+	precompiledInternal := hasPrecompiledStd(buildCtx)
+	importPath := importPathForDir(pkgDirAbs, srcs, buildCtx)
+	explored := map[string]*parsedTreeNode{}
+	testPkg, err := parseRecursive(fset, pkgDirAbs, importPath, pkgDirAbs, srcs, buildCtx, false, precompiledInternal, internalTestFiles, explored)
+	if err != nil {
+		return nil, false, err
+	}
+	xtestPkg, err := parseRecursive(fset, pkgDirAbs, importPath+"_test", pkgDirAbs, srcs, buildCtx, false, precompiledInternal, externalTestFiles, explored)
+	if err != nil {
+		return nil, false, err
+	}
+	// Find all test functions to generate the test main package
+	funcs := &testFuncs{
+		ImportPath:            importPath,
+		MainStartFuzz:         srcs.toolchainMinorVersion(buildCtx) >= 18,
+		TestMainExitCodeFromM: srcs.toolchainMinorVersion(buildCtx) >= 15,
+		Test2JSON:             test2JSON,
+		SyncOnRunEnd:          test2JSON && srcs.toolchainMinorVersion(buildCtx) >= 16,
+	}
+	if err = funcs.load(fset, testPkg, "_test", srcs); err != nil {
+		return nil, false, err
+	}
+	if xtestPkg != nil {
+		funcs.XTestImportPath = xtestPkg.importPath
+		if err = funcs.load(fset, xtestPkg, "_xtest", srcs); err != nil {
+			return nil, false, err
+		}
+	}
+	testMainDir := filepath.Join(buildDir, "_testmain")
+	if err = os.MkdirAll(testMainDir, 0755); err != nil {
+		return nil, false, err
+	}
+	testMainFile, err := os.Create(filepath.Join(testMainDir, "_testmain.go"))
+	if err != nil {
+		return nil, false, err
+	}
+	defer testMainFile.Close()
+	if err = testMainTemplate.Execute(testMainFile, funcs); err != nil {
+		return nil, false, err
+	}
+	// The test main package only has standard library imports besides the test packages
+	testMain := &parsedTreeNode{
+		name:        "main",
+		dir:         testMainDir,
+		importPath:  "main",
+		goFileNames: []string{"_testmain.go"},
+		generated:   true,
+	}
+	testMainPos := token.Position{Filename: testMainFile.Name()}
+	for _, imp := range testMainStdImports(funcs) {
+		if err = parseImport(fset, testMain, imp, testMainPos, pkgDirAbs, srcs, buildCtx, precompiledInternal, explored); err != nil {
+			return nil, false, err
+		}
+	}
+	testMain.imports = append(testMain.imports, testPkg)
+	if xtestPkg != nil {
+		testMain.imports = append(testMain.imports, xtestPkg)
+	}
+	testMain.goDebug = testPkg.goDebug
+	if xtestPkg != nil {
+		testMain.goDebug = append(append([]string{}, testMain.goDebug...), xtestPkg.goDebug...)
+	}
+	if err = checkCgo(testMain, srcs, buildCtx); err != nil {
+		return nil, false, err
+	}
+	return testMain, precompiledInternal, nil
+}
+
+// importPathForDir returns the import path of the package at dir, based on its go.mod file (or on its GOPATH entry in
+// GOPATH mode, see gopathMode).
+func importPathForDir(dir string, srcs *sources, ctx build.Context) string {
+	if gopathMode(dir, srcs) {
+		if importPath := gopathImportPath(dir, ctx); importPath != "" {
+			return importPath
+		}
+		return "_" + filepath.ToSlash(dir) // Like the go command for directories outside GOPATH
+	}
+	goModDir, modulePath, _ := findAndParseGoMod(dir, srcs)
+	if modulePath == "" {
+		return "_" + filepath.ToSlash(dir) // Like the go command for directories outside modules
+	}
+	rel, err := filepath.Rel(goModDir, dir)
+	if err != nil || rel == "." {
+		return modulePath
+	}
+	return modulePath + "/" + filepath.ToSlash(rel)
+}
+
+// load finds all test functions in the _test.go files of node (package files are parsed with imports only, so the
+// test files are parsed again).
+func (t *testFuncs) load(fset *token.FileSet, node *parsedTreeNode, pkgAlias string, srcs *sources) error {
+	for _, fileName := range node.goFileNames {
+		if !strings.HasSuffix(fileName, "_test.go") {
+			continue
+		}
+		file, err := srcs.parseFile(fset, filepath.Join(node.dir, fileName), parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil {
+				continue
+			}
+			name := fn.Name.Name
+			switch {
+			case name == "TestMain":
+				if isTestFuncWithArg(fn, "T") {
+					t.Tests = append(t.Tests, testFunc{Package: pkgAlias, Name: name})
+					break // Old TestMain(t *testing.T) tests
+				}
+				if !isTestFuncWithArg(fn, "M") {
+					continue
+				}
+				if t.TestMain != nil {
+					return errors.New(fset.Position(fn.Pos()).String() + ": multiple definitions of TestMain")
+				}
+				t.TestMain = &testFunc{Package: pkgAlias, Name: name}
+			case isTestName(name, "Test") && isTestFuncWithArg(fn, "T"):
+				t.Tests = append(t.Tests, testFunc{Package: pkgAlias, Name: name})
+			case isTestName(name, "Benchmark") && isTestFuncWithArg(fn, "B"):
+				t.Benchmarks = append(t.Benchmarks, testFunc{Package: pkgAlias, Name: name})
+			case isTestName(name, "Fuzz") && isTestFuncWithArg(fn, "F") && t.MainStartFuzz:
+				t.FuzzTargets = append(t.FuzzTargets, testFunc{Package: pkgAlias, Name: name})
+			default:
+				continue
+			}
+			t.setReferenced(pkgAlias)
+		}
+		for _, ex := range doc.Examples(file) {
+			if ex.Output == "" && !ex.EmptyOutput {
+				continue // Examples without output comments are compiled but not executed
+			}
+			t.Examples = append(t.Examples, testFunc{Package: pkgAlias, Name: "Example" + ex.Name, Output: ex.Output, Unordered: ex.Unordered})
+			t.setReferenced(pkgAlias)
+		}
+	}
+	return nil
+}
+
+func (t *testFuncs) setReferenced(pkgAlias string) {
+	if pkgAlias == "_test" {
+		t.ImportTest = true
+	} else {
+		t.ImportXTest = true
+	}
+}
+
+// isTestName reports whether name is a test function name for the given prefix (e.g. TestXxx but not Testxxx).
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) { // "Test" is ok
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// isTestFuncWithArg reports whether fn has a single *testing.<argType> parameter and no results.
+func isTestFuncWithArg(fn *ast.FuncDecl, argType string) bool {
+	if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 || len(fn.Type.Params.List) != 1 ||
+		len(fn.Type.Params.List[0].Names) > 1 {
+		return false
+	}
+	star, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+	if sel, ok := star.X.(*ast.SelectorExpr); ok {
+		return sel.Sel.Name == argType
+	}
+	if ident, ok := star.X.(*ast.Ident); ok { // Dot import of testing
+		return ident.Name == argType
+	}
+	return false
+}
+
+// testMainStdImports returns the standard library imports of the generated test main package.
+func testMainStdImports(t *testFuncs) []string {
+	imports := []string{"os", "testing", "testing/internal/testdeps"}
+	if t.TestMain != nil && t.TestMainExitCodeFromM {
+		imports = append(imports, "reflect")
+	}
+	if t.Test2JSON {
+		imports = append(imports, "bufio", "encoding/json", "flag", "io", "io/ioutil", "regexp", "strconv", "strings", "sync", "time")
+	}
+	return imports
+}
+
+var testMainTemplate = template.Must(template.New("main").Funcs(template.FuncMap{"quote": func(s string) string {
+	return fmt.Sprintf("%q", s)
+}}).Parse(`// Code generated by buildhelper. DO NOT EDIT.
+
+package main
+
+import (
+	"os"
+{{if and .TestMain .TestMainExitCodeFromM}}	"reflect"
+{{end}}	"testing"
+	"testing/internal/testdeps"
+{{if .Test2JSON}}
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+{{end}}
+{{if .ImportTest}}	_test {{quote .ImportPath}}
+{{else}}	_ {{quote .ImportPath}}
+{{end}}{{if .XTestImportPath}}{{if .ImportXTest}}	_xtest {{quote .XTestImportPath}}
+{{else}}	_ {{quote .XTestImportPath}}
+{{end}}{{end}})
+
+var tests = []testing.InternalTest{
+{{range .Tests}}	{ {{quote .Name}}, {{.Package}}.{{.Name}} },
+{{end}}}
+
+var benchmarks = []testing.InternalBenchmark{
+{{range .Benchmarks}}	{ {{quote .Name}}, {{.Package}}.{{.Name}} },
+{{end}}}
+{{if .MainStartFuzz}}
+var fuzzTargets = []testing.InternalFuzzTarget{
+{{range .FuzzTargets}}	{ {{quote .Name}}, {{.Package}}.{{.Name}} },
+{{end}}}
+{{end}}
+var examples = []testing.InternalExample{
+{{range .Examples}}	{ {{quote .Name}}, {{.Package}}.{{.Name}}, {{quote .Output}}, {{.Unordered}} },
+{{end}}}
+
+func main() {
+{{if .Test2JSON}}	// Convert the verbose output to test2json events while the tests run
+	stdout = os.Stdout
+	var output io.Reader
+	os.Stdout, output, closeOutput = captureOutput()
+	go test2json(output)
+	exitCode := runTests()
+	os.Stdout = stdout
+	closeOutput()
+	<-converted
+	finish(exitCode != 0)
+	os.Exit(exitCode)
+}
+
+func runTests() int {
+{{end}}{{if .MainStartFuzz}}	m := testing.MainStart({{template "deps" .}}, tests, benchmarks, fuzzTargets, examples)
+{{else}}	m := testing.MainStart({{template "deps" .}}, tests, benchmarks, examples)
+{{end}}{{if .Test2JSON}}	for _, name := range []string{"test.v"{{if .SyncOnRunEnd}}, "test.paniconexit0"{{end}}} {
+		if err := flag.Set(name, "true"); err != nil { // Registered by MainStart
+			panic(err)
+		}
+	}
+{{end}}{{if .TestMain}}	{{.TestMain.Package}}.{{.TestMain.Name}}(m)
+{{if .TestMainExitCodeFromM}}	exitCode := int(reflect.ValueOf(m).Elem().FieldByName("exitCode").Int())
+{{else}}	exitCode := 0 // TestMain must call os.Exit
+{{end}}{{else}}	exitCode := m.Run()
+{{end}}{{if .Test2JSON}}	return exitCode
+{{else}}	os.Exit(exitCode)
+{{end}}}
+{{if .Test2JSON}}
+// testEvent is a test2json event
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string  ` + "`json:\",omitempty\"`" + `
+	Elapsed float64 ` + "`json:\",omitempty\"`" + `
+	Output  string  ` + "`json:\",omitempty\"`" + `
+}
+
+var (
+	testStartRe = regexp.MustCompile(` + "`^=== (RUN|PAUSE|CONT|NAME) +(\\S+)`" + `)
+	testEndRe   = regexp.MustCompile(` + "`^ *--- (PASS|FAIL|SKIP): (\\S+) \\(([0-9.]+)s\\)`" + `)
+)
+
+const syncLine = "\x00test2json-sync" // Written to the output to wait until the converter read everything before it
+
+var (
+	start       = time.Now()
+	stdout      *os.File              // The actual stdout, while os.Stdout is captured
+	closeOutput func()                // Ends the captured output
+	converted   = make(chan struct{}) // Closed when all the captured output is converted
+	caughtUp    = make(chan struct{}) // Receives each syncLine read by the converter
+	failed      bool                  // The tests printed FAIL last
+	finishOnce  sync.Once
+)
+{{if .SyncOnRunEnd}}
+// syncDeps converts all the output and emits the final event when m.Run ends (it restores PanicOnExit0), as TestMain
+// usually calls os.Exit right after it.
+type syncDeps struct {
+	testdeps.TestDeps
+}
+
+func (d syncDeps) SetPanicOnExit0(v bool) {
+	d.TestDeps.SetPanicOnExit0(v)
+	if !v {
+		_, _ = os.Stdout.WriteString(syncLine + "\n")
+		<-caughtUp
+		finish(failed)
+	}
+}
+{{end}}
+// emit writes a test2json event of the package to the actual stdout
+func emit(e testEvent) {
+	e.Time = time.Now()
+	e.Package = {{quote .ImportPath}}
+	_ = json.NewEncoder(stdout).Encode(e)
+}
+
+// finish emits the final event of the package, once
+func finish(fail bool) {
+	finishOnce.Do(func() {
+		action := "pass"
+		if fail {
+			action = "fail"
+		}
+		emit(testEvent{Action: action, Elapsed: time.Since(start).Seconds()})
+	})
+}
+
+// captureOutput returns the file that replaces stdout while the tests run, with a reader of everything written to it
+// (until closeOutput is called). Pipes are not supported by every target (e.g. js/wasm): a temporary file is followed
+// instead.
+func captureOutput() (w *os.File, output io.Reader, closeOutput func()) {
+	if r, w, err := os.Pipe(); err == nil {
+		return w, r, func() { _ = w.Close() }
+	}
+	w, err := ioutil.TempFile("", "test-output")
+	if err != nil {
+		panic(err)
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Remove(w.Name()) // Still readable while open (where supported), and never leaked
+	closed := make(chan struct{})
+	return w, &followReader{r, closed}, func() {
+		_ = w.Close()
+		close(closed)
+		_ = os.Remove(w.Name())
+	}
+}
+
+// followReader reads a file that is still being written, until it is closed (like tail -f).
+type followReader struct {
+	f      *os.File
+	closed chan struct{}
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-r.closed:
+			return r.f.Read(p) // Anything written before closing
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// test2json converts the verbose test output to test2json events (one JSON object per line) as it is written
+func test2json(output io.Reader) {
+	defer close(converted)
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(nil, 1<<24)
+	current := "" // The test that is currently writing output
+	for scanner.Scan() {
+		if scanner.Text() == syncLine {
+			caughtUp <- struct{}{}
+			continue
+		}
+		line := scanner.Text() + "\n"
+		if line == "PASS\n" || line == "FAIL\n" {
+			failed = line == "FAIL\n"
+		}
+		if m := testStartRe.FindStringSubmatch(line); m != nil {
+			current = m[2]
+			if m[1] != "NAME" {
+				emit(testEvent{Action: strings.ToLower(m[1]), Test: current})
+			}
+			emit(testEvent{Action: "output", Test: current, Output: line})
+		} else if m := testEndRe.FindStringSubmatch(line); m != nil {
+			emit(testEvent{Action: "output", Test: m[2], Output: line})
+			elapsed, _ := strconv.ParseFloat(m[3], 64)
+			emit(testEvent{Action: strings.ToLower(m[1]), Test: m[2], Elapsed: elapsed})
+			current = ""
+			if i := strings.LastIndex(m[2], "/"); i >= 0 {
+				current = m[2][:i] // Back to the parent test
+			}
+		} else {
+			emit(testEvent{Action: "output", Test: current, Output: line})
+		}
+	}
+}
+{{end}}{{define "deps"}}{{if .SyncOnRunEnd}}syncDeps{}{{else}}testdeps.TestDeps{}{{end}}{{end}}`))
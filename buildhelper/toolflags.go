@@ -0,0 +1,94 @@
+package main
+
+import (
+	"go/build"
+	"strings"
+)
+
+// The flags of the compile and asm tools changed across Go releases: these functions generate the same flags as the go
+// build command of the toolchain at GOROOT (see cmd/go/internal/work/gc.go of each release).
+
+// compileToolFlags returns the output-independent flags of the compile tool for the given package.
+func compileToolFlags(node *parsedTreeNode, srcs *sources, buildCtx build.Context) []string {
+	minor := srcs.toolchainMinorVersion(buildCtx)
+	flags := []string{"-p", node.importPath}
+	if lang := langFlag(node.goVersion, srcs, buildCtx); lang != "" {
+		flags = append(flags, lang)
+	}
+	if node.internal {
+		flags = append(flags, "-std")
+		if minor < 22 && isRuntimePackage(node.importPath, minor) {
+			// Special checks and pragmas of the runtime (since Go 1.22 the compiler knows the runtime packages)
+			flags = append(flags, "-+")
+		}
+	}
+	// Tell the compiler that it has the entire package, except for the few standard packages with forward declarations
+	// supplied by the runtime
+	if len(node.assemblyFileNames) == 0 && !(node.internal && hasRuntimeForwardDecls(node.importPath)) {
+		flags = append(flags, "-complete")
+	}
+	return flags
+}
+
+// asmToolFlags returns the output-independent flags of the asm tool for the given package.
+func asmToolFlags(node *parsedTreeNode, srcs *sources, buildCtx build.Context) []string {
+	minor := srcs.toolchainMinorVersion(buildCtx)
+	var flags []string
+	if minor >= 19 {
+		flags = append(flags, "-p", node.importPath)
+	}
+	flags = append(flags, "-D", "GOOS_"+buildCtx.GOOS, "-D", "GOARCH_"+buildCtx.GOARCH)
+	if node.internal {
+		if minor >= 22 {
+			flags = append(flags, "-std")
+		} else if minor >= 16 && isAsmRuntimePackage(node.importPath) {
+			flags = append(flags, "-compiling-runtime")
+		}
+	}
+	flags = append(flags, subArchAsmDefines(srcs, buildCtx)...)
+	if trimPath := srcs.overlayTrimPath(node.dir, node.assemblyFileNames); trimPath != "" {
+		flags = append(flags, "-trimpath", trimPath)
+	}
+	return flags
+}
+
+// isRuntimePackage reports whether the standard package is compiled as part of the runtime (compile -+ flag).
+func isRuntimePackage(importPath string, minor int) bool {
+	if importPath == "runtime" || strings.HasPrefix(importPath, "runtime/internal/") {
+		return true
+	}
+	switch importPath {
+	case "internal/cpu", "internal/bytealg":
+		return true
+	case "internal/abi":
+		return minor >= 17
+	case "internal/goarch", "internal/goos":
+		return minor >= 19
+	case "internal/coverage/rtcov":
+		return minor >= 20
+	case "internal/godebugs", "internal/goexperiment":
+		return minor >= 21
+	}
+	return false
+}
+
+// isAsmRuntimePackage reports whether the assembly of the standard package is part of the runtime (asm
+// -compiling-runtime flag, from Go 1.16 to 1.21).
+func isAsmRuntimePackage(importPath string) bool {
+	switch importPath {
+	case "runtime", "reflect", "syscall", "internal/bytealg":
+		return true
+	}
+	return strings.HasPrefix(importPath, "runtime/internal/")
+}
+
+// hasRuntimeForwardDecls reports whether the standard package declares functions implemented by the runtime, so it
+// can't be compiled with -complete.
+func hasRuntimeForwardDecls(importPath string) bool {
+	switch importPath {
+	case "bytes", "internal/poll", "net", "os", "runtime/metrics", "runtime/pprof", "runtime/trace", "sync", "syscall",
+		"time":
+		return true
+	}
+	return false
+}
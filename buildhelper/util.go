@@ -4,7 +4,14 @@ import (
 	"encoding/base64"
 	"go/build"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
 func goSrcPath(ctx build.Context) string {
@@ -15,8 +22,93 @@ func goPkgPath(ctx build.Context) string {
 	return filepath.Join(ctx.GOROOT, "pkg", ctx.GOOS+"_"+ctx.GOARCH)
 }
 
-func pkgArchiveCacheFor(importPath string, buildDir string) string {
-	return filepath.Join(buildDir, "_pkg_"+hashString(importPath)+".a")
+func pkgArchiveCacheFor(actionID string, cacheDir string) string {
+	return filepath.Join(cacheDir, "_pkg_"+actionID+".a")
+}
+
+// toolchainVersion returns the (memoized) version of the Go toolchain at GOROOT, as it is needed for every package.
+func (srcs *sources) toolchainVersion(ctx build.Context) string {
+	version, ok := srcs.toolchainVersions[ctx.GOROOT]
+	if !ok {
+		version = readToolchainVersion(ctx)
+		srcs.toolchainVersions[ctx.GOROOT] = version
+	}
+	return version
+}
+
+// readToolchainVersion reads the version of the Go toolchain at GOROOT, from its VERSION file or the header of its
+// precompiled runtime archive (or returns the version that built this tool as a fallback).
+func readToolchainVersion(ctx build.Context) string {
+	versionBytes, err := ioutil.ReadFile(filepath.Join(ctx.GOROOT, "VERSION"))
+	if err == nil {
+		if version := strings.TrimSpace(strings.SplitN(string(versionBytes), "\n", 2)[0]); version != "" {
+			return version
+		}
+	}
+	if version := archiveToolchainVersion(filepath.Join(goPkgPath(ctx), "runtime.a")); version != "" {
+		return version
+	}
+	return runtime.Version()
+}
+
+// archiveToolchainVersion returns the version of the toolchain that compiled the given archive, from the header of its
+// export data, or "" if unknown.
+func archiveToolchainVersion(archive string) string {
+	header := archiveHeader(archive)
+	if len(header) < 5 {
+		return ""
+	}
+	return header[4]
+}
+
+// archiveHeader returns the fields of the header of the export data of the given archive ("go object <goos> <goarch>
+// <version> [<variant>] [X:<experiments>]"), or nil if unknown.
+func archiveHeader(archive string) []string {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	header := make([]byte, 1024)
+	n, _ := io.ReadFull(f, header)
+	i := strings.Index(string(header[:n]), "go object ")
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(strings.SplitN(string(header[i:n]), "\n", 2)[0])
+}
+
+// toolchainMinorVersion returns the minor version of the Go toolchain at GOROOT (e.g. 18 for go1.18.3).
+// Development versions that can't be parsed are assumed to be newer than any release.
+func (srcs *sources) toolchainMinorVersion(ctx build.Context) int {
+	version := srcs.toolchainVersion(ctx)
+	i := strings.Index(version, "go1.")
+	if i < 0 {
+		return math.MaxInt32
+	}
+	version = version[i+len("go1."):]
+	end := 0
+	for end < len(version) && version[end] >= '0' && version[end] <= '9' {
+		end++
+	}
+	minor, err := strconv.Atoi(version[:end])
+	if err != nil {
+		return math.MaxInt32
+	}
+	return minor
+}
+
+// readDirNames returns the names of the entries of the given source directory (that may be mounted), sorted.
+func (srcs *sources) readDirNames(dir string) ([]string, error) {
+	entries, err := srcs.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
 }
 
 func hashString(s string) string {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vendorModule is a module listed in vendor/modules.txt.
+type vendorModule struct {
+	mod         module.Version
+	replacement module.Version // zero if not replaced
+	explicit    bool           // explicitly required by go.mod (## explicit)
+	goVersion   string         // go directive of its go.mod file (## go 1.17), since Go 1.17
+}
+
+// vendorModules is a parsed vendor/modules.txt file, the output of go mod vendor.
+type vendorModules struct {
+	dir      string
+	modules  []*vendorModule
+	packages map[string]*vendorModule // vendored package import path -> module providing it
+	// annotated is set if any module has ## annotations (go mod vendor of Go 1.14 or later)
+	annotated bool
+}
+
+// loadVendorModules returns the parsed vendor/modules.txt file of the given module root directory, or nil if the module
+// does not vendor its dependencies with a modules.txt file.
+func loadVendorModules(goModDir string, srcs *sources) (*vendorModules, error) {
+	if vm, ok := srcs.vendorModules[goModDir]; ok {
+		return vm, nil
+	}
+	vendorDir := filepath.Join(goModDir, "vendor")
+	data, err := srcs.readFile(filepath.Join(vendorDir, "modules.txt"))
+	if os.IsNotExist(err) {
+		srcs.vendorModules[goModDir] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	vm := &vendorModules{dir: vendorDir, packages: map[string]*vendorModule{}}
+	var current *vendorModule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "## ") { // Annotations of the current module
+			vm.annotated = true
+			if current == nil {
+				continue
+			}
+			for _, annotation := range strings.Split(strings.TrimPrefix(line, "## "), ";") {
+				annotation = strings.TrimSpace(annotation)
+				if annotation == "explicit" {
+					current.explicit = true
+				} else if strings.HasPrefix(annotation, "go ") {
+					current.goVersion = strings.TrimSpace(strings.TrimPrefix(annotation, "go "))
+				}
+			}
+		} else if strings.HasPrefix(line, "# ") { // Module line: # path [version] [=> replacement [version]]
+			fields := strings.Fields(strings.TrimPrefix(line, "# "))
+			current = &vendorModule{}
+			if arrow := indexOf(fields, "=>"); arrow >= 0 {
+				if arrow+1 < len(fields) {
+					current.replacement.Path = fields[arrow+1]
+				}
+				if arrow+2 < len(fields) {
+					current.replacement.Version = fields[arrow+2]
+				}
+				fields = fields[:arrow]
+			}
+			if len(fields) == 0 {
+				return nil, errors.New("invalid module line in vendor/modules.txt: " + line)
+			}
+			current.mod.Path = fields[0]
+			if len(fields) > 1 {
+				current.mod.Version = fields[1]
+			}
+			vm.modules = append(vm.modules, current)
+		} else if line != "" && current != nil { // Package provided by the current module
+			vm.packages[line] = current
+		}
+	}
+	srcs.vendorModules[goModDir] = vm
+	return vm, nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// findDirForImport returns the vendored directory of the given import path ("" if it is not vendored).
+func (vm *vendorModules) findDirForImport(importPath string) string {
+	if _, ok := vm.packages[importPath]; !ok {
+		return ""
+	}
+	return filepath.Join(vm.dir, filepath.FromSlash(importPath))
+}
+
+// checkVendorConsistency verifies that the vendor/modules.txt file of the module of dirOrFile (if any) matches the
+// requirements and replacements of its go.mod file. It reports all inconsistencies with the format of the go command,
+// instead of failing later with confusing compile errors because of a stale vendor directory.
+func checkVendorConsistency(dirOrFile string, srcs *sources) error {
+	goModDir, modulePath, _ := findAndParseGoMod(dirOrFile, srcs)
+	if modulePath == "" {
+		return nil
+	}
+	vm, err := loadVendorModules(goModDir, srcs)
+	if err != nil || vm == nil {
+		return err
+	}
+	goMod, err := parseMainGoModFile(filepath.Join(goModDir, "go.mod"), srcs)
+	if err != nil {
+		return err
+	}
+	// Before Go 1.14, modules.txt files have no annotations and only the listed versions are checked
+	preAnnotations := !vm.annotated && (goMod.Go == nil || semver.Compare("v"+goMod.Go.Version, "v1.14") < 0)
+	var problems []string
+	report := func(m module.Version, format string, args ...interface{}) {
+		problems = append(problems, formatModule(m)+": "+fmt.Sprintf(format, args...))
+	}
+	vendored := map[module.Version]*vendorModule{}
+	vendoredVersions := map[string]string{}
+	for _, m := range vm.modules {
+		vendored[m.mod] = m
+		if m.mod.Version != "" {
+			vendoredVersions[m.mod.Path] = m.mod.Version
+		}
+	}
+	for _, r := range goMod.Require {
+		if m, ok := vendored[r.Mod]; ok && m.explicit {
+			continue
+		}
+		if preAnnotations {
+			if version := vendoredVersions[r.Mod.Path]; version != r.Mod.Version {
+				report(r.Mod, "is explicitly required in go.mod, but vendor/modules.txt indicates %s@%s", r.Mod.Path, version)
+			}
+		} else {
+			report(r.Mod, "is explicitly required in go.mod, but not marked as explicit in vendor/modules.txt")
+		}
+	}
+	for _, r := range goMod.Replace {
+		var replacement module.Version
+		if m, ok := vendored[r.Old]; ok {
+			replacement = m.replacement
+		}
+		if replacement.Path == "" {
+			// Before Go 1.14, replacements of all versions and of modules without packages were not listed
+			if !preAnnotations || r.Old.Version != "" && vendoredVersions[r.Old.Path] == r.Old.Version {
+				report(r.Old, "is replaced in go.mod, but not marked as replaced in vendor/modules.txt")
+			}
+		} else if replacement != r.New {
+			report(r.Old, "is replaced by %s in go.mod, but marked as replaced by %s in vendor/modules.txt",
+				formatModule(r.New), formatModule(replacement))
+		}
+	}
+	required := map[module.Version]bool{}
+	for _, r := range goMod.Require {
+		required[r.Mod] = true
+	}
+	for _, m := range vm.modules {
+		if m.explicit && !required[m.mod] {
+			report(m.mod, "is marked as explicit in vendor/modules.txt, but not explicitly required in go.mod")
+		}
+	}
+	for _, m := range vm.modules {
+		if m.replacement.Path != "" && !isReplaced(goMod, m.mod) {
+			report(m.mod, "is marked as replaced in vendor/modules.txt, but not replaced in go.mod")
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("go: inconsistent vendoring in " + goModDir + ":\n\t" + strings.Join(problems, "\n\t") +
+		"\n\n\tTo sync the vendor directory, run:\n\t\tgo mod vendor")
+}
+
+// isReplaced reports whether a replace directive of the go.mod file applies to the given module version.
+func isReplaced(goMod *modfile.File, m module.Version) bool {
+	for _, r := range goMod.Replace {
+		if r.Old.Path == m.Path && (r.Old.Version == "" || r.Old.Version == m.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatModule(m module.Version) string {
+	if m.Version == "" {
+		return m.Path
+	}
+	return m.String()
+}
+
+// vendorModulesForDir returns the vendored modules of the module of dirOrFile (nil if it does not vendor them).
+func vendorModulesForDir(dirOrFile string, srcs *sources) *vendorModules {
+	goModDir, modulePath, _ := findAndParseGoMod(dirOrFile, srcs)
+	if modulePath == "" {
+		return nil
+	}
+	vm, _ := loadVendorModules(goModDir, srcs) // Errors are reported by checkVendorConsistency
+	return vm
+}
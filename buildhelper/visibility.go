@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"path/filepath"
+	"strings"
+)
+
+// checkImportVisibility applies the internal and vendor visibility rules of the go command to the import of importPath
+// (resolved to importDir, compiled as actualPath, isInternal if it belongs to the standard library) by node.
+func checkImportVisibility(node *parsedTreeNode, importPath, actualPath, importDir string, isInternal bool, srcs *sources, buildCtx build.Context) error {
+	if node.generated {
+		return nil // Generated packages may import anything (e.g. the test main imports testing/internal/testdeps)
+	}
+	importerPath := node.importPath
+	if importerPath == "main" && !node.internal { // The input package, that may also be part of a module
+		importerPath = importPathForDir(node.dir, srcs, buildCtx)
+	}
+	importerPath = strings.TrimSuffix(importerPath, "_test") // External test packages share the directory
+	// Vendored packages are imported by the path of the vendored package
+	if i := pathElementIndex(importPath, "vendor"); i >= 0 {
+		return fmt.Errorf("package %s imports %s: must be imported as %s", importerPath, importPath,
+			strings.TrimPrefix(importPath[i:], "vendor/"))
+	}
+	// The packages vendored by the standard library are only visible to the standard library
+	stdVendorDir := filepath.Join(goSrcPath(buildCtx), "vendor") + string(filepath.Separator)
+	if strings.HasPrefix(importDir, stdVendorDir) && !node.internal {
+		return fmt.Errorf("package %s imports %s: use of package vendored by the standard library not allowed",
+			importerPath, importPath)
+	}
+	// Internal packages are only visible to the packages rooted at the parent of the internal directory (compared with
+	// the actual paths, that include the vendor directories of the standard library and of GOPATH mode)
+	i := pathElementIndex(actualPath, "internal")
+	if i < 0 {
+		return nil
+	}
+	parent := strings.TrimSuffix(actualPath[:i], "/")
+	var allowed bool
+	if parent == "" { // Internal packages of the standard library root (or of a module named internal)
+		allowed = node.internal == isInternal
+	} else {
+		allowed = (node.internal || !isInternal) && (importerPath == parent || strings.HasPrefix(importerPath, parent+"/"))
+	}
+	if !allowed {
+		return fmt.Errorf("package %s imports %s: use of internal package %s not allowed", importerPath, importPath,
+			importPath)
+	}
+	return nil
+}
+
+// pathElementIndex returns the index of the first element of importPath equal to elem, or -1 if none.
+func pathElementIndex(importPath, elem string) int {
+	if importPath == elem || strings.HasPrefix(importPath, elem+"/") {
+		return 0
+	}
+	if i := strings.Index(importPath, "/"+elem+"/"); i >= 0 {
+		return i + 1
+	}
+	if strings.HasSuffix(importPath, "/"+elem) {
+		return len(importPath) - len(elem)
+	}
+	return -1
+}
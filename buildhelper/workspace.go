@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/mod/modfile"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// workspaceModule is a module used by a go.work workspace.
+type workspaceModule struct {
+	path, dir string
+}
+
+// workspace is a parsed go.work file with all of its modules.
+type workspace struct {
+	dir       string
+	goVersion string // go directive of the go.work file
+	modules   []workspaceModule
+	// replaces are applied to every workspace module: replacements of go.work override those of the go.mod files of the
+	// workspace modules (local replacement directories are absolute)
+	replaces []*modfile.Replace
+}
+
+// findAndParseGoWork finds the go.work file for the given directory (following GOWORK semantics) and parses it along
+// with the go.mod files of all the modules it uses. It returns nil if workspace mode is not enabled. Like the go
+// command, an unreadable or invalid go.work file is an error: the build does not fall back to the module of dirOrFile.
+func findAndParseGoWork(dirOrFile string, srcs *sources) (*workspace, error) {
+	goWork := os.Getenv("GOWORK")
+	if goWork == "off" {
+		return nil, nil
+	}
+	if goWork == "" {
+		goWork = findGoWork(dirOrFile, srcs)
+		if goWork == "" {
+			return nil, nil
+		}
+	}
+	goWork, err := filepath.Abs(goWork)
+	if err != nil {
+		return nil, err
+	}
+	if ws, ok := srcs.goWorkspaces[goWork]; ok { // Needed for every import
+		return ws, nil
+	}
+	ws, err := parseGoWork(goWork, srcs)
+	if err != nil {
+		return nil, err
+	}
+	srcs.goWorkspaces[goWork] = ws
+	return ws, nil
+}
+
+// parseGoWork parses the go.work file at the absolute path goWork, along with the go.mod files of all the modules it
+// uses.
+func parseGoWork(goWork string, srcs *sources) (*workspace, error) {
+	data, err := srcs.readFile(goWork)
+	if err != nil {
+		return nil, fmt.Errorf("reading go.work file: %v", err)
+	}
+	workFile, err := modfile.ParseWork(goWork, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("errors parsing go.work file:\n%v", err)
+	}
+	ws := &workspace{dir: filepath.Dir(goWork), goVersion: defaultGoModVersion}
+	if workFile.Go != nil {
+		ws.goVersion = workFile.Go.Version
+	}
+	workReplaced := map[string]bool{}
+	for _, r := range workFile.Replace {
+		ws.replaces = append(ws.replaces, absReplace(r, ws.dir))
+		workReplaced[r.Old.Path] = true
+	}
+	for _, use := range workFile.Use {
+		moduleDir := use.Path
+		if !filepath.IsAbs(moduleDir) {
+			moduleDir = filepath.Join(ws.dir, moduleDir)
+		}
+		goModDir, modulePath, replaces := findAndParseGoMod(moduleDir, srcs)
+		if goModDir != moduleDir || modulePath == "" {
+			log.Println("Ignoring go.work use directive without a go.mod file:", use.Path)
+			continue
+		}
+		ws.modules = append(ws.modules, workspaceModule{path: modulePath, dir: moduleDir})
+		for _, r := range replaces {
+			if !workReplaced[r.Old.Path] {
+				ws.replaces = append(ws.replaces, r)
+			}
+		}
+	}
+	return ws, nil
+}
+
+// findGoWork returns the path of the first go.work file in dir or any of its parents ("" if none).
+func findGoWork(dirOrFile string, srcs *sources) string {
+	dir, err := filepath.Abs(dirOrFile)
+	if err != nil {
+		return ""
+	}
+	for {
+		possibleGoWork := filepath.Join(dir, "go.work")
+		if stat, err := srcs.stat(possibleGoWork); err == nil && !stat.IsDir() {
+			return possibleGoWork
+		}
+		parentDir := filepath.Dir(dir)
+		if parentDir == dir {
+			return ""
+		}
+		dir = parentDir
+	}
+}
+
+// findDirForImport resolves an import path to a directory of one of the workspace modules, choosing the module with the
+// longest matching path ("" if not found). Replaced and required modules are resolved by the module build list.
+func (ws *workspace) findDirForImport(importPath string, srcs *sources) string {
+	modules := append([]workspaceModule{}, ws.modules...)
+	sort.Slice(modules, func(i, j int) bool { return len(modules[i].path) > len(modules[j].path) })
+	for _, m := range modules {
+		if dir := findPackageInModule(importPath, m.path, m.dir, srcs); dir != "" {
+			return dir
+		}
+	}
+	return ""
+}
@@ -12,7 +12,7 @@ import {
 } from "@fortawesome/free-solid-svg-icons"
 import {FontAwesomeIcon} from "@fortawesome/react-fontawesome"
 import React from "react"
-import {deleteRecursive, exportZip, fsAsync, importZip, readCache, readDir, stat, writeCache} from "../fs/utils"
+import {deleteRecursive, exportZip, fsAsync, importZip, readCache, readDir, stat} from "../fs/utils"
 import {goBuild} from "../go/build"
 import {goRun} from "../go/run"
 import {VirtualFileBrowser} from "../settings/vfs"
@@ -340,46 +340,16 @@ export class ActionBuild extends Action<{ fb: VirtualFileBrowser, folderOrFilePa
         let buildTarget = ["js", "wasm"]
         if (this.props.fb.props.getBuildTarget) buildTarget = this.props.fb.props.getBuildTarget()
         let buildTargetIsJsWasm = buildTarget.join("/") === "js/wasm"
-        let hackedCodePreviousVal: Uint8Array
+        let buildHelperFlags: string[] = []
         if (this.props.fb.props.getBuildInjectStopCode && this.mainGoFile && buildTargetIsJsWasm &&
             this.props.fb.props.getBuildInjectStopCode()) {
-            // HACK: Inject stop code to be able to stop forever-running Go executables.
-            // It spawns an initialization goroutine that sets up a global stop function with a given name that can be called from JS
-            let codeBytes = await readCache(this.props.fb.props.fs, this.mainGoFile)
-            hackedCodePreviousVal = codeBytes
-            let code = new TextDecoder().decode(codeBytes)
-            let packageMainStart = code.search(/package\s+main/)
-            if (packageMainStart === -1) {
-                throw new Error("Could not find package main in " + this.mainGoFile)
-            }
-            let packageMainLength = code.substring(packageMainStart).indexOf("\n") + 2
-            let packageMainEnd = packageMainStart + packageMainLength
-            code = code.substring(0, packageMainEnd) + `import (
-                // hackFmt23894589 "fmt"
-                hackOs23894589 "os"
-                hackRuntime23894589 "runtime"
-                hackJs23894589 "syscall/js"
-            )\n` + code.substring(packageMainEnd) + `\nfunc init() {
-                if hackRuntime23894589.GOOS == "js" {
-                    jsGlobalStopFnName := hackOs23894589.Getenv("` + BUILD_HACK_STOP_FN_ENV_VAR_NAME + `")
-                    // hackFmt23894589.Println("Setting global function to force stop at", jsGlobalStopFnName)
-                    if jsGlobalStopFnName != "" {
-                        hackJs23894589.Global().Set(jsGlobalStopFnName, hackJs23894589.FuncOf(func (this hackJs23894589.Value, args []hackJs23894589.Value) interface{} {
-                            hackOs23894589.Exit(195) // Forces exit: set a custom exit code
-                            return nil
-                        }))
-                    }
-                }
-            }`
-            // console.log("Hacked code:", code)
-            let codeBytes2 = new TextEncoder().encode(code)
-            await writeCache(this.props.fb.props.fs, this.mainGoFile, codeBytes2)
+            // Instrument the main package to be able to stop forever-running Go executables (buildhelper generates a file
+            // that sets up a global stop function with the name given by the environment, that can be called from JS),
+            // to report panics and to flush the last line of output on exit
+            buildHelperFlags = ["-instrument", "stop,panicjson,flush"]
         }
         let success = await goBuild(fs, buildFile, outFile, buildTags, buildTarget[0], buildTarget[1], {},
-            this.props.progressOverride || this.props.fb.props.setProgress)
-        if (hackedCodePreviousVal) { // Restore previous code
-            await writeCache(this.props.fb.props.fs, this.mainGoFile, hackedCodePreviousVal)
-        }
+            this.props.progressOverride || this.props.fb.props.setProgress, buildHelperFlags)
         await this.props.fb.refreshFilesCwd()
         if (success) {
             // Run after build if configured
@@ -100,7 +100,8 @@ export const openVirtualFSMemory = () => {
                 console.error("Cannot write at an specific position of stdout/stderr")
                 return -1
             }
-            outputBuf += decoder.decode(buf)
+            const text = decoder.decode(buf)
+            outputBuf += text
             while (true) {
                 const nl = outputBuf.lastIndexOf("\n")
                 if (nl === -1) break
@@ -112,6 +113,18 @@ export const openVirtualFSMemory = () => {
             return myMemoryFS.writeSyncOriginal2(fd, buf, offset, length, position)
         }
     }
+    myMemoryFS.fsyncOriginal2 = myMemoryFS.fsync
+    myMemoryFS.fsync = function (fd, callback) {
+        if (fd === 1 || fd === 2) { // Flush the last incomplete line (e.g. on exit of instrumented Go executables)
+            if (outputBuf.length > 0) {
+                console.log(outputBuf)
+                outputBuf = ""
+            }
+            callback(null)
+        } else {
+            return myMemoryFS.fsyncOriginal2(fd, callback)
+        }
+    }
     myMemoryFS.writeOriginal2 = myMemoryFS.write
     myMemoryFS.write = function (fd, buf, offset, length, position, callback) {
         let res = myMemoryFS.writeSync(fd, buf, offset, length, position, callback) // HACK: reuses sync code: shouldn't matter
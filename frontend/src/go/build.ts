@@ -1,72 +1,221 @@
-import {mkdirs, readCache, stat} from "../fs/utils"
+import {fsAsync, mkdirs, readCache, stat} from "../fs/utils"
 import {defaultGoEnv, goRun} from "./run"
 
 export const GOROOT = "/usr/lib/go/"
 export const CmdGoPath = GOROOT + "bin/go"
 export const CmdBuildHelperPath = GOROOT + "bin/buildhelper"
 export const CmdGoToolsPath = GOROOT + "pkg/tool/js_wasm" // compile & link
+export const BuildCacheDir = "/tmp/build/cache" // Compiled packages, shared by all builds (keyed by content hashes)
+export const BuildModCacheDir = "/tmp/build/modcache" // Modules extracted from the module proxy
+export const GoProxyDir = "/goproxy" // Optional file:// module proxy (the contents of $GOMODCACHE/cache/download)
 
-const performBuildInternal = async (fs: any, commands: string[][], cwd: string,
-                                    buildEnv: { [p: string]: string } = defaultGoEnv, progress?: (p: number) => Promise<any>): Promise<boolean> => {
-    let numCommands = commands.length
-    for (let i = 0; i < numCommands; i++) {
-        let commandParts = commands[i]
-        // Add full path to go installation for tool command (works for compile and link)
-        commandParts[0] = CmdGoToolsPath + "/" + commandParts[0]
-        let exitCode = await goRun(fs, commandParts[0], commandParts.slice(1), cwd, buildEnv).runPromise
-        if (exitCode !== 0) {
-            console.error("Build failed, check logs. Exit code: ", exitCode)
+// BuildAction is a single tool invocation of the plan generated by buildhelper
+interface BuildAction {
+    id: string
+    deps: string[]
+    inputs: string[]
+    outputs: string[]
+    command: string[]
+    package?: string // Import path of the built package (none for the link action)
+    env?: string[] // KEY=value settings of the target variant (GOAMD64, GOEXPERIMENT...), on top of the build env
+}
+
+// BuildDiagnostic is a structured error of a build (see buildhelper's diagnostics.go), with positions in the sources of
+// the user (the editor may underline it)
+export interface BuildDiagnostic {
+    package?: string // Import path of the package (none for link errors)
+    file?: string // None for errors without a position
+    line?: number
+    column?: number // None if unknown (e.g. asm errors)
+    severity: "error" | "warning"
+    message: string
+    source: string // buildhelper (parse and resolution errors), or the tool: compile, asm, link...
+}
+
+// toolDiagnostics parses the output of a failed action, like buildhelper: lines are "file:line[:column]: message"
+// (or just a message), and lines indented with a tab continue the message of the previous one
+const toolDiagnostics = (action: BuildAction, output: string): BuildDiagnostic[] => {
+    let diagnostics: BuildDiagnostic[] = []
+    for (const line of output.replace(/\n+$/, "").split("\n")) {
+        if (line.trim() === "") continue
+        if (line.startsWith("\t") && diagnostics.length > 0) {
+            diagnostics[diagnostics.length - 1].message += "\n" + line
+            continue
+        }
+        let diagnostic: BuildDiagnostic = {package: action.package, severity: "error", message: line, source: action.command[0]}
+        let m = line.match(/^(.+?):(\d+)(?::(\d+))?: (.*)$/)
+        if (m) {
+            diagnostic.file = m[1]
+            diagnostic.line = parseInt(m[2])
+            if (m[3]) diagnostic.column = parseInt(m[3])
+            diagnostic.message = m[4]
+        }
+        diagnostics.push(diagnostic)
+    }
+    return diagnostics
+}
+
+// readBuildHelperDiagnostics reads the diagnostics written by buildhelper when it fails
+const readBuildHelperDiagnostics = async (fs: any, buildFilesTmpDir: string): Promise<BuildDiagnostic[]> => {
+    try {
+        return JSON.parse(new TextDecoder("utf-8").decode(await readCache(fs, buildFilesTmpDir + "/diagnostics.json")))
+    } catch (e) {
+        return [] // Failed before parsing (e.g. invalid flags)
+    }
+}
+
+// performBuildInternal runs all actions of the plan, starting each one as soon as all of its dependencies finished
+// (running at most maxParallel actions at the same time)
+const performBuildInternal = async (fs: any, actions: BuildAction[], cwd: string,
+                                    buildEnv: { [p: string]: string } = defaultGoEnv, progress?: (p: number) => Promise<any>,
+                                    maxParallel: number = goBuildMaxParallel,
+                                    onDiagnostics?: (diagnostics: BuildDiagnostic[]) => Promise<any>): Promise<boolean> => {
+    let numActions = actions.length
+    let pending = [...actions]
+    let running = new Map<string, Promise<{ id: string, exitCode: number }>>()
+    let finished = new Set<string>()
+    let outputs = new Map<string, string>() // Captured output of each action, for diagnostics
+    while (pending.length > 0 || running.size > 0) {
+        // Start all ready actions (the plan is ordered, so this also keeps the sequential order when maxParallel is 1)
+        for (let i = 0; i < pending.length && running.size < maxParallel; i++) {
+            let action = pending[i]
+            if (!action.deps.every(dep => finished.has(dep))) continue
+            pending.splice(i--, 1)
+            // Add full path to go installation for tool command (works for compile and link)
+            let commandPath = CmdGoToolsPath + "/" + action.command[0]
+            let actionEnv = {...buildEnv}
+            for (const setting of action.env || []) {
+                const i = setting.indexOf("=")
+                actionEnv[setting.slice(0, i)] = setting.slice(i + 1)
+            }
+            outputs.set(action.id, "")
+            let onOutput = (text: string) => outputs.set(action.id, outputs.get(action.id) + text)
+            running.set(action.id, goRun(fs, commandPath, action.command.slice(1), cwd, actionEnv, onOutput).runPromise
+                .then(exitCode => ({id: action.id, exitCode})))
+        }
+        if (running.size === 0) {
+            console.error("Build failed, the plan has actions with unsatisfiable dependencies:", pending)
+            return false
+        }
+        let result = await Promise.race(running.values())
+        running.delete(result.id)
+        if (result.exitCode !== 0) {
+            console.error("Build failed, check logs. Action: ", result.id, ", exit code: ", result.exitCode)
+            await Promise.all(running.values()) // Let other running actions finish
+            await removeUnfinishedOutputs(fs, actions, finished)
+            if (onDiagnostics) {
+                let failed = actions.find(action => action.id === result.id)
+                await onDiagnostics(toolDiagnostics(failed, outputs.get(result.id)))
+            }
             return false
         }
-        if (progress) await progress(goBuildParsingProgress + (1 - goBuildParsingProgress) * (i + 1) / numCommands)
+        finished.add(result.id)
+        if (progress) await progress(goBuildParsingProgress + (1 - goBuildParsingProgress) * finished.size / numActions)
         // Breathe: lets the browser render a frame between commands (and other tasks run)
         await new Promise(resolve => setTimeout(resolve, 0))
     }
     return true
 }
 
+// removeUnfinishedOutputs deletes any output written by an action that did not finish successfully. Outputs may be
+// written by more than one action (e.g. assembly is packed into the compiled archive), so they would otherwise be
+// reused as valid cache entries by later builds.
+const removeUnfinishedOutputs = async (fs: any, actions: BuildAction[], finished: Set<string>) => {
+    for (let action of actions) {
+        if (finished.has(action.id)) continue
+        for (let output of action.outputs) {
+            try {
+                await fsAsync(fs, "unlink", output)
+            } catch (e) {
+                // Not written yet
+            }
+        }
+    }
+}
+
 const goBuildParsingProgress = 0.25
+// goBuildMaxParallel is the default number of actions of the plan that run at the same time, each one in its own wasm
+// instance that captures its own output (for diagnostics)
+export const goBuildMaxParallel = 4
 
-// performBuild will build any source directory with vendored dependencies (go mod vendor), to the given exe
-export const goBuild = async (fs: any, sourcePath: string, outputExePath: string, buildTags: string[] = [],
-                              goos = "js", goarch = "wasm", envOverrides: { [key: string]: string } = {},
-                              progress?: (p: number) => Promise<any>): Promise<boolean> => {
-    if (progress) await progress(0)
-    let buildFilesTmpDir = "/tmp/build/" + goos + "_" + goarch + "/" + buildTags.join("_")
-    // Do not delete previous intermediary build files (as they may be used as a cache)
-    await mkdirs(fs, buildFilesTmpDir)
-    // Generate the configuration files and commands
-    let buildEnv = {...defaultGoEnv, "GOOS": goos, "GOARCH": goarch, ...envOverrides}
+// runBuildHelper runs buildhelper for any source directory, file or zip archive of a directory, returning its exit code
+const runBuildHelper = async (fs: any, sourcePath: string, buildFilesTmpDir: string, buildTags: string[],
+                              buildEnv: { [p: string]: string }, buildHelperFlags: string[]): Promise<number> => {
     let buildTagsStr = buildTags.join(",")
     let sourceStat = await stat(fs, sourcePath)
     let exitCode: number
-    if (sourceStat.isFile()) {
+    if (sourceStat.isFile() && sourcePath.endsWith(".zip")) {
+        // Plan straight from the archive: only the files to compile are extracted (next to it, without the extension)
+        let sourceDir = sourcePath.substring(0, sourcePath.length - ".zip".length)
+        let sourceParentDir = sourcePath.substring(0, sourcePath.lastIndexOf("/"))
+        exitCode = await goRun(fs, CmdBuildHelperPath, [...buildHelperFlags, "-zip", sourcePath, sourceDir, buildFilesTmpDir, buildTagsStr], sourceParentDir, buildEnv).runPromise
+    } else if (sourceStat.isFile()) {
         let splitAt = sourcePath.lastIndexOf("/")
         let sourceParentDir = sourcePath.substring(0, splitAt)
         let sourceRelPath = sourcePath.substring(splitAt + 1)
-        exitCode = await goRun(fs, CmdBuildHelperPath, [sourceRelPath, buildFilesTmpDir, buildTagsStr], sourceParentDir, buildEnv).runPromise
+        exitCode = await goRun(fs, CmdBuildHelperPath, [...buildHelperFlags, sourceRelPath, buildFilesTmpDir, buildTagsStr], sourceParentDir, buildEnv).runPromise
     } else if (sourceStat.isDirectory()) {
-        exitCode = await goRun(fs, CmdBuildHelperPath, [".", buildFilesTmpDir, buildTagsStr], sourcePath, buildEnv).runPromise
+        exitCode = await goRun(fs, CmdBuildHelperPath, [...buildHelperFlags, ".", buildFilesTmpDir, buildTagsStr], sourcePath, buildEnv).runPromise
     } else {
         console.error("Unsupported go build target", sourceStat)
-        return false
+        return -1
     }
+    return exitCode
+}
+
+// performBuild will build any source directory (or zip archive of one) with vendored dependencies (go mod vendor) or
+// with its dependencies in the GoProxyDir module proxy, to the given exe.
+// Extra buildhelper flags may be given, e.g. ["-test"] to build a test binary for the package instead.
+// If the build fails, onDiagnostics receives its errors (with positions in the sources, if any).
+// Up to maxParallel independent actions of the plan run at the same time (see goBuildMaxParallel).
+export const goBuild = async (fs: any, sourcePath: string, outputExePath: string, buildTags: string[] = [],
+                              goos = "js", goarch = "wasm", envOverrides: { [key: string]: string } = {},
+                              progress?: (p: number) => Promise<any>, buildHelperFlags: string[] = [],
+                              onDiagnostics?: (diagnostics: BuildDiagnostic[]) => Promise<any>,
+                              maxParallel: number = goBuildMaxParallel): Promise<boolean> => {
+    if (progress) await progress(0)
+    let buildFilesTmpDir = "/tmp/build/" + goos + "_" + goarch + "/" + buildTags.join("_")
+    // Do not delete previous intermediary build files (compiled packages are reused from the cache)
+    await mkdirs(fs, buildFilesTmpDir)
+    await mkdirs(fs, BuildCacheDir)
+    // Generate the configuration files and commands
+    let buildEnv = {...defaultGoEnv, "GOOS": goos, "GOARCH": goarch, "BUILDHELPER_CACHE": BuildCacheDir,
+        "GOMODCACHE": BuildModCacheDir, "GOPROXY": "file://" + GoProxyDir, ...envOverrides}
+    let exitCode = await runBuildHelper(fs, sourcePath, buildFilesTmpDir, buildTags, buildEnv, buildHelperFlags)
     if (exitCode !== 0) {
         console.error("Build failed, check logs. Exit code: ", exitCode)
+        if (onDiagnostics) await onDiagnostics(await readBuildHelperDiagnostics(fs, buildFilesTmpDir))
         return false
     }
     if (progress) await progress(goBuildParsingProgress)
     // Breathe: lets the browser render a frame between commands (and other tasks run)
     await new Promise(resolve => setTimeout(resolve, 0))
-    // Read generated commands
-    let commandsJson = await readCache(fs, buildFilesTmpDir + "/commands.json")
-    // console.log("Read commands file:", commandsJson)
-    let commandsArray = JSON.parse(new TextDecoder("utf-8").decode(commandsJson))
-    // Execute all compile and link commands to generate a.out
-    let success = await performBuildInternal(fs, commandsArray, buildFilesTmpDir, buildEnv, progress)
+    // Read generated plan
+    let planJson = await readCache(fs, buildFilesTmpDir + "/plan.json")
+    // console.log("Read plan file:", planJson)
+    let actions: BuildAction[] = JSON.parse(new TextDecoder("utf-8").decode(planJson))
+    // Execute all compile and link actions to generate a.out
+    let success = await performBuildInternal(fs, actions, buildFilesTmpDir, buildEnv, progress, maxParallel,
+        onDiagnostics)
     if (success) {
         // Move executable to wanted location
         await fs.rename(buildFilesTmpDir + "/a.out", outputExePath)
     } // else build failed
     return success
 }
+
+// goCheck type-checks the packages of the user in any source directory (or file, or zip archive of a directory) without
+// building them (buildhelper -check), which is much faster than goBuild. It returns whether there were no errors, and
+// gives the errors to onDiagnostics.
+export const goCheck = async (fs: any, sourcePath: string, buildTags: string[] = [], goos = "js", goarch = "wasm",
+                              envOverrides: { [key: string]: string } = {},
+                              onDiagnostics?: (diagnostics: BuildDiagnostic[]) => Promise<any>): Promise<boolean> => {
+    let buildFilesTmpDir = "/tmp/build/" + goos + "_" + goarch + "/" + buildTags.join("_")
+    await mkdirs(fs, buildFilesTmpDir)
+    await mkdirs(fs, BuildCacheDir)
+    let buildEnv = {...defaultGoEnv, "GOOS": goos, "GOARCH": goarch, "BUILDHELPER_CACHE": BuildCacheDir,
+        "GOMODCACHE": BuildModCacheDir, "GOPROXY": "file://" + GoProxyDir, ...envOverrides}
+    let exitCode = await runBuildHelper(fs, sourcePath, buildFilesTmpDir, buildTags, buildEnv, ["-check"])
+    if (exitCode !== 0 && onDiagnostics) await onDiagnostics(await readBuildHelperDiagnostics(fs, buildFilesTmpDir))
+    return exitCode === 0
+}
@@ -30,7 +30,35 @@ export const goClassWithVFS = async (fs: any, globalHack: any): Promise<any> =>
     return globalHack.Go
 }
 
-export const goRun = (fs: any, fsUrl: string, argv: string[] = [], cwd = "/", env: { [key: string]: string } = defaultGoEnv):
+// outputCapturingFS returns the file system as seen by a single executable, that also gives its output (stdout and
+// stderr) to onOutput. Each executable has its own, so the outputs of executables running at the same time never mix.
+const outputCapturingFS = (fs: any, onOutput: (text: string) => void): any => {
+    const decoder = new TextDecoder("utf-8")
+    const capture = (fd: number, buf: Uint8Array, offset: number, length: number) => {
+        if (fd !== 1 && fd !== 2) return
+        if (offset && length) { // Like the file system (see memfs.ts)
+            buf = buf.slice(offset, offset + length)
+        }
+        onOutput(decoder.decode(buf, {stream: true}))
+    }
+    const writeSync = (fd, buf, offset, length, position, callback) => {
+        capture(fd, buf, offset, length)
+        return fs.writeSync(fd, buf, offset, length, position, callback)
+    }
+    const write = (fd, buf, offset, length, position, callback) => {
+        capture(fd, buf, offset, length)
+        return fs.write(fd, buf, offset, length, position, callback)
+    }
+    // Everything else (including any state set through it) is the shared file system
+    return new Proxy(fs, {
+        get: (target, prop) => prop === "writeSync" ? writeSync : prop === "write" ? write : target[prop]
+    })
+}
+
+// goRun runs a Go executable. The output (stdout and stderr) is also given to onOutput, if set, even if other
+// executables run at the same time.
+export const goRun = (fs: any, fsUrl: string, argv: string[] = [], cwd = "/", env: { [key: string]: string } = defaultGoEnv,
+                      onOutput?: (text: string) => void):
     { runPromise: Promise<number>; forceStop: () => Promise<void> } => {
     let cssLog = "background: #222; color: #bada55"
     console.log("%c>>>>> runGoExe:", cssLog, fsUrl, argv, {cwd}, env)
@@ -42,7 +70,7 @@ export const goRun = (fs: any, fsUrl: string, argv: string[] = [], cwd = "/", en
             let go: any
             try {
                 // Build an instance the modified Go class from wasm_exec.js
-                let GoClass = await goClassWithVFS(fs, globalHack);
+                let GoClass = await goClassWithVFS(onOutput ? outputCapturingFS(fs, onOutput) : fs, globalHack);
                 go = new GoClass()
                 go.argv = go.argv.concat(argv) // First is the program name, already set
                 env[BUILD_HACK_STOP_FN_ENV_VAR_NAME] = stopFnName